@@ -0,0 +1,73 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//CurrentAge calculates the age of a stored response as per rfc7234 section
+//4.2.3. requesttime is when the request that produced the response was sent,
+//responsetime when the response was received, both by the local clock.
+//
+//	apparent_age = max(0, response_time - date_value);
+//	response_delay = response_time - request_time;
+//	corrected_age_value = age_value + response_delay;
+//	corrected_initial_age = max(apparent_age, corrected_age_value);
+//	resident_time = now - response_time;
+//	current_age = corrected_initial_age + resident_time;
+func CurrentAge(reshdrs http.Header, requesttime, responsetime, now time.Time) time.Duration {
+	apparentage := time.Duration(0)
+	if date, err := http.ParseTime(reshdrs.Get("Date")); err == nil {
+		apparentage = responsetime.Sub(date)
+		if apparentage < 0 {
+			apparentage = time.Duration(0)
+		}
+	}
+	responsedelay := time.Duration(0)
+	if !requesttime.IsZero() && responsetime.After(requesttime) {
+		responsedelay = responsetime.Sub(requesttime)
+	}
+	correctedagevalue := AgeValue(reshdrs) + responsedelay
+	age := apparentage
+	if correctedagevalue > age {
+		age = correctedagevalue
+	}
+	if residenttime := now.Sub(responsetime); residenttime > 0 {
+		age += residenttime
+	}
+	return age
+}
+
+//AgeValue returns the Age header of a response as per rfc7234 section 5.1,
+//or zero if it is missing or invalid.
+func AgeValue(reshdrs http.Header) time.Duration {
+	val := reshdrs.Get("Age")
+	if val == "" {
+		return time.Duration(0)
+	}
+	secs, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		if numerr, ok := err.(*strconv.NumError); ok && numerr.Err == strconv.ErrRange && secs > 0 {
+			secs = maxdeltaseconds
+		} else {
+			return time.Duration(0)
+		}
+	}
+	if secs < 0 {
+		return time.Duration(0)
+	}
+	if secs > maxdeltaseconds {
+		secs = maxdeltaseconds
+	}
+	return time.Duration(secs) * time.Second
+}
+
+//FormatAge formats an age as a delta-seconds value for the Age header.
+func FormatAge(age time.Duration) string {
+	secs := int64(age / time.Second)
+	if secs > maxdeltaseconds {
+		secs = maxdeltaseconds
+	}
+	return strconv.FormatInt(secs, 10)
+}
@@ -0,0 +1,50 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_CurrentAge(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	requested := now.Add(-10 * time.Second)
+	received := now.Add(-8 * time.Second)
+
+	res := make(http.Header)
+	if age := CurrentAge(res, requested, received, now); age != 10*time.Second {
+		t.Error("age without Date or Age should be response delay plus resident time 10s got", age)
+	}
+	res.Set("Age", "100")
+	if age := CurrentAge(res, requested, received, now); age != 110*time.Second {
+		t.Error("age should be corrected Age value plus resident time 110s got", age)
+	}
+	res.Set("Date", received.Add(-300*time.Second).UTC().Format(http.TimeFormat))
+	if age := CurrentAge(res, requested, received, now); age != 308*time.Second {
+		t.Error("age should be apparent age plus resident time 308s got", age)
+	}
+	res.Set("Date", received.Add(time.Hour).UTC().Format(http.TimeFormat))
+	res.Set("Age", "junk")
+	if age := CurrentAge(res, requested, received, now); age != 10*time.Second {
+		t.Error("future Date and invalid Age should not count got", age)
+	}
+	res.Set("Age", "99999999999999999999")
+	if age := AgeValue(res); age != maxdeltaseconds*time.Second {
+		t.Error("huge Age should be capped got", age)
+	}
+}
+
+func Test_DecideAge(t *testing.T) {
+	res := make(http.Header)
+	res.Set("Cache-Control", "max-age=300")
+	res.Set("Age", "100")
+	pub := NewPublicDeterminer()
+	d := pub.Decide("GET", 200, make(http.Header), res)
+	if d.TTL != 300*time.Second || d.Age != 100*time.Second || d.Remaining() != 200*time.Second {
+		t.Error("response with Age 100 and max-age 300 should have 200s remaining got", d)
+	}
+	_, _, _, _, ttl, _ := pub.Determine("GET", 200, make(http.Header), res)
+	if ttl != 200*time.Second {
+		t.Error("Determine ttl should be remaining freshness 200s got", ttl)
+	}
+}
@@ -0,0 +1,183 @@
+package gohttpcache
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Largest delta-seconds value we need to represent, see rfc7234 section 1.2.1
+const maxdeltaseconds = 2147483648
+
+var (
+	ErrDirectiveMissing   = errors.New("directive not present")
+	ErrDirectiveInvalid   = errors.New("directive has an invalid argument")
+	ErrDirectiveDuplicate = errors.New("directive present more than once with different arguments")
+)
+
+//CacheControl holds the directives parsed out of Cache-Control (or Pragma)
+//header fields. Directive names are lowercased, arguments are unquoted.
+//Every occurrence of a directive is kept, in order, so duplicates can be
+//detected. A directive without an argument is stored with an empty value.
+type CacheControl map[string][]string
+
+//ParseCacheControl tokenizes the values of Cache-Control header fields as per
+//rfc7234 section 5.2
+//
+//	Cache-Control   = 1#cache-directive
+//	cache-directive = token [ "=" ( token / quoted-string ) ]
+//
+//Malformed directives are skipped rather than failing the whole header.
+func ParseCacheControl(values []string) CacheControl {
+	cc := make(CacheControl)
+	for _, v := range values {
+		for len(v) > 0 {
+			var name, arg string
+			var ok bool
+			name, arg, v, ok = nextdirective(v)
+			if ok {
+				cc[name] = append(cc[name], arg)
+			}
+		}
+	}
+	return cc
+}
+
+//ParsePragma tokenizes the values of Pragma header fields as per rfc7234
+//section 5.4, which shares its grammar with Cache-Control.
+func ParsePragma(values []string) CacheControl {
+	return ParseCacheControl(values)
+}
+
+//nextdirective consumes one comma separated element from s. ok is false for
+//empty or malformed elements, rest is whatever is left after the element.
+func nextdirective(s string) (name, arg, rest string, ok bool) {
+	s = strings.TrimLeft(s, " \t")
+	i := 0
+	for i < len(s) && istokenchar(s[i]) {
+		i++
+	}
+	name = strings.ToLower(s[:i])
+	s = strings.TrimLeft(s[i:], " \t")
+	ok = len(name) > 0
+	if len(s) > 0 && s[0] == '=' {
+		s = strings.TrimLeft(s[1:], " \t")
+		if len(s) > 0 && s[0] == '"' {
+			arg, s, ok = quotedstring(s)
+			ok = ok && len(name) > 0
+		} else {
+			j := 0
+			for j < len(s) && istokenchar(s[j]) {
+				j++
+			}
+			arg = s[:j]
+			s = s[j:]
+			ok = ok && len(arg) > 0
+		}
+		s = strings.TrimLeft(s, " \t")
+	}
+	if len(s) > 0 && s[0] != ',' {
+		//Garbage after the directive, skip to the next element
+		ok = false
+	}
+	if idx := strings.IndexByte(s, ','); idx >= 0 {
+		rest = s[idx+1:]
+	}
+	return
+}
+
+//quotedstring consumes a quoted-string from the start of s and returns its
+//unescaped contents.
+func quotedstring(s string) (value, rest string, ok bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	//Unterminated, swallow the rest of the field.
+	return "", "", false
+}
+
+//istokenchar reports whether c is a tchar as per rfc7230 section 3.2.6
+func istokenchar(c byte) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+//Has reports if a directive is present.
+func (self CacheControl) Has(directive string) bool {
+	_, ok := self[strings.ToLower(directive)]
+	return ok
+}
+
+//Get returns the argument of the first occurrence of a directive.
+func (self CacheControl) Get(directive string) (arg string, ok bool) {
+	args, ok := self[strings.ToLower(directive)]
+	if ok {
+		arg = args[0]
+	}
+	return
+}
+
+//Seconds returns the delta-seconds argument of a directive such as max-age.
+//As per rfc7234 section 4.2.1 a directive that appears more than once with
+//conflicting arguments is invalid, and so is one with a non numeric argument.
+//Values too large to represent are capped as per section 1.2.1.
+func (self CacheControl) Seconds(directive string) (secs int64, err error) {
+	args, ok := self[strings.ToLower(directive)]
+	if !ok {
+		err = ErrDirectiveMissing
+		return
+	}
+	for _, arg := range args[1:] {
+		if arg != args[0] {
+			err = ErrDirectiveDuplicate
+			return
+		}
+	}
+	if len(args[0]) == 0 || strings.TrimLeft(args[0], "0123456789") != "" {
+		err = ErrDirectiveInvalid
+		return
+	}
+	secs, err = strconv.ParseInt(args[0], 10, 64)
+	if err != nil || secs > maxdeltaseconds {
+		secs = maxdeltaseconds
+		err = nil
+	}
+	return
+}
+
+//Fields returns the field-names listed as the argument of a qualified
+//directive such as no-cache="Set-Cookie" or private="X-User". qualified is
+//false when the directive is present without an argument, meaning it applies
+//to the whole response.
+func (self CacheControl) Fields(directive string) (fields []string, qualified bool) {
+	args, ok := self[strings.ToLower(directive)]
+	if !ok {
+		return
+	}
+	qualified = true
+	for _, arg := range args {
+		if arg == "" {
+			//An unqualified occurrence wins over any field-names.
+			return nil, false
+		}
+		for _, f := range strings.Split(arg, ",") {
+			f = strings.TrimSpace(f)
+			if f != "" {
+				fields = append(fields, http.CanonicalHeaderKey(f))
+			}
+		}
+	}
+	return
+}
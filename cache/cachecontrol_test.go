@@ -0,0 +1,124 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type CacheControlTestCase struct {
+	Header   []string
+	Expected CacheControl
+}
+
+func Test_ParseCacheControl(t *testing.T) {
+	cases := []CacheControlTestCase{
+		{[]string{"public, max-age=300"}, CacheControl{"public": {""}, "max-age": {"300"}}},
+		{[]string{"Public", "MAX-AGE=300"}, CacheControl{"public": {""}, "max-age": {"300"}}},
+		{[]string{"s-maxage=60"}, CacheControl{"s-maxage": {"60"}}},
+		{[]string{`no-cache="Set-Cookie, X-Foo", max-age=1`}, CacheControl{"no-cache": {"Set-Cookie, X-Foo"}, "max-age": {"1"}}},
+		{[]string{`private="a\"b"`}, CacheControl{"private": {`a"b`}}},
+		{[]string{"max-age = 5 , , no-store"}, CacheControl{"max-age": {"5"}, "no-store": {""}}},
+		{[]string{"max-age=5, max-age=10"}, CacheControl{"max-age": {"5", "10"}}},
+		{[]string{"no-cache-foo"}, CacheControl{"no-cache-foo": {""}}},
+		{[]string{"max-age=5 junk, public"}, CacheControl{"public": {""}}},
+		{[]string{`ext="unterminated, public`}, CacheControl{}},
+		{[]string{"=5, public"}, CacheControl{"public": {""}}},
+	}
+	for _, c := range cases {
+		cc := ParseCacheControl(c.Header)
+		if !reflect.DeepEqual(cc, c.Expected) {
+			t.Error(c.Header, "should parse to", c.Expected, "got", cc)
+		}
+	}
+}
+
+func Test_CacheControlSeconds(t *testing.T) {
+	cc := ParseCacheControl([]string{"max-age=5, max-age=10, s-maxage=abc, min-fresh=99999999999, max-stale=3, max-stale=3"})
+	if _, err := cc.Seconds("max-age"); err != ErrDirectiveDuplicate {
+		t.Error("conflicting max-age should be", ErrDirectiveDuplicate, "got", err)
+	}
+	if _, err := cc.Seconds("s-maxage"); err != ErrDirectiveInvalid {
+		t.Error("non numeric s-maxage should be", ErrDirectiveInvalid, "got", err)
+	}
+	if _, err := cc.Seconds("no-cache"); err != ErrDirectiveMissing {
+		t.Error("absent no-cache should be", ErrDirectiveMissing, "got", err)
+	}
+	if secs, err := cc.Seconds("min-fresh"); err != nil || secs != maxdeltaseconds {
+		t.Error("huge min-fresh should be capped to", maxdeltaseconds, "got", secs, err)
+	}
+	if secs, err := cc.Seconds("max-stale"); err != nil || secs != 3 {
+		t.Error("repeated identical max-stale should be 3 got", secs, err)
+	}
+}
+
+func Test_CacheControlFields(t *testing.T) {
+	cc := ParseCacheControl([]string{`no-cache="set-cookie, x-foo", private, public`})
+	fields, qualified := cc.Fields("no-cache")
+	if !qualified || !reflect.DeepEqual(fields, []string{"Set-Cookie", "X-Foo"}) {
+		t.Error("no-cache fields should be [Set-Cookie X-Foo] got", fields, qualified)
+	}
+	if fields, qualified = cc.Fields("private"); qualified || fields != nil {
+		t.Error("unqualified private should have no fields got", fields, qualified)
+	}
+}
+
+func Test_DeterminerDirectiveMatching(t *testing.T) {
+	//s-maxage must not be mistaken for max-age by a private cache.
+	res := make(http.Header)
+	res.Set("Cache-Control", "s-maxage=300")
+	dt := &DeterminerTestCase{
+		200,
+		"GET",
+		make(http.Header),
+		res,
+		DeterminerExpected{true, true, true, false, time.Duration(300) * time.Second, nil},
+		DeterminerExpected{true, true, true, true, time.Duration(0), nil},
+		"s-maxage only applies to shared caches",
+	}
+	dt.runtest(t)
+
+	//Unknown extensions that merely contain a known directive name are ignored.
+	res = make(http.Header)
+	res.Set("Cache-Control", "max-age=60, no-cache-foo, x-private")
+	dt = &DeterminerTestCase{
+		200,
+		"GET",
+		make(http.Header),
+		res,
+		DeterminerExpected{true, true, true, false, time.Duration(60) * time.Second, nil},
+		DeterminerExpected{true, true, true, false, time.Duration(60) * time.Second, nil},
+		"extensions are not no-cache or private",
+	}
+	dt.runtest(t)
+
+	//Conflicting max-age values make the response stale as per 4.2.1
+	res = make(http.Header)
+	res.Add("Cache-Control", "max-age=60")
+	res.Add("Cache-Control", "max-age=120")
+	dt = &DeterminerTestCase{
+		200,
+		"GET",
+		make(http.Header),
+		res,
+		DeterminerExpected{true, true, true, false, time.Duration(0), nil},
+		DeterminerExpected{true, true, true, false, time.Duration(0), nil},
+		"duplicate max-age is invalid",
+	}
+	dt.runtest(t)
+
+	//Invalid Expires means already expired.
+	res = make(http.Header)
+	res.Set("Expires", "0")
+	dt = &DeterminerTestCase{
+		200,
+		"GET",
+		make(http.Header),
+		res,
+		DeterminerExpected{true, true, true, false, time.Duration(0), nil},
+		DeterminerExpected{true, true, true, false, time.Duration(0), nil},
+		"Expires: 0 is in the past",
+	}
+	dt.runtest(t)
+}
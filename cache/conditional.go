@@ -0,0 +1,118 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Preconditions evaluates the conditional request header fields of rfc7232
+//against a stored response, in the order given by section 6. It returns
+//http.StatusNotModified or http.StatusPreconditionFailed when the client
+//should get that instead of the stored response, or 0 to serve it as usual.
+func Preconditions(method string, reqhdrs http.Header, status int, reshdrs http.Header) int {
+	//Section 5, preconditions only apply to a 2xx response.
+	if status < 200 || status > 299 {
+		return 0
+	}
+	etag := reshdrs.Get("ETag")
+	lastmodified, lastmodifiedok := validatordate(reshdrs)
+	getorhead := method == "GET" || method == "HEAD"
+	if ifmatch := reqhdrs.Get("If-Match"); ifmatch != "" {
+		//Step 1
+		if !MatchETag(ifmatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(reqhdrs.Get("If-Unmodified-Since")); err == nil && lastmodifiedok {
+		//Step 2
+		if lastmodified.After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if ifnonematch := reqhdrs.Get("If-None-Match"); ifnonematch != "" {
+		//Step 3
+		if MatchETag(ifnonematch, etag, true) {
+			if getorhead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(reqhdrs.Get("If-Modified-Since")); err == nil && getorhead && lastmodifiedok {
+		//Step 4
+		if !lastmodified.After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+//validatordate is the modification date of a stored response, Last-Modified
+//or failing that Date, as per rfc7234 section 4.3.2
+func validatordate(reshdrs http.Header) (date time.Time, ok bool) {
+	date, err := http.ParseTime(reshdrs.Get("Last-Modified"))
+	if err != nil {
+		date, err = http.ParseTime(reshdrs.Get("Date"))
+	}
+	return date, err == nil
+}
+
+//MatchETag checks an If-Match or If-None-Match field value against the
+//entity-tag of a response, using weak or strong comparison as per rfc7232
+//section 2.3.2. "*" matches any response.
+func MatchETag(fieldvalue, etag string, weak bool) bool {
+	if strings.TrimSpace(fieldvalue) == "*" {
+		return true
+	}
+	etagweak, etagopaque, ok := parseetag(etag)
+	if !ok {
+		return false
+	}
+	for _, candidate := range splitetags(fieldvalue) {
+		candidateweak, candidateopaque, ok := parseetag(candidate)
+		if !ok || candidateopaque != etagopaque {
+			continue
+		}
+		if weak || (!candidateweak && !etagweak) {
+			return true
+		}
+	}
+	return false
+}
+
+//parseetag splits an entity-tag into its weakness and opaque-tag
+func parseetag(etag string) (weak bool, opaque string, ok bool) {
+	etag = strings.TrimSpace(etag)
+	if strings.HasPrefix(etag, "W/") {
+		weak = true
+		etag = etag[2:]
+	}
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return
+	}
+	return weak, etag, true
+}
+
+//splitetags splits a list of entity-tags. Commas are valid inside an
+//opaque-tag, so we cannot simply split on them.
+func splitetags(fieldvalue string) (etags []string) {
+	start := -1
+	quoted := false
+	for i := 0; i < len(fieldvalue); i++ {
+		c := fieldvalue[i]
+		switch {
+		case c == '"':
+			if start < 0 {
+				start = i
+			}
+			if quoted {
+				etags = append(etags, fieldvalue[start:i+1])
+				start = -1
+			}
+			quoted = !quoted
+		case quoted:
+		case c == 'W' && start < 0:
+			start = i
+		}
+	}
+	return
+}
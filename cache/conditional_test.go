@@ -0,0 +1,68 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+type PreconditionTestCase struct {
+	Method   string
+	Header   string
+	Value    string
+	Expected int
+}
+
+func Test_Preconditions(t *testing.T) {
+	lastmodified := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	res := make(http.Header)
+	res.Set("ETag", `W/"v1"`)
+	res.Set("Last-Modified", lastmodified.Format(http.TimeFormat))
+	before := lastmodified.Add(-time.Hour).Format(http.TimeFormat)
+	after := lastmodified.Add(time.Hour).Format(http.TimeFormat)
+	cases := []PreconditionTestCase{
+		{"GET", "If-None-Match", `"v1"`, http.StatusNotModified},
+		{"GET", "If-None-Match", `"v0", W/"v1"`, http.StatusNotModified},
+		{"GET", "If-None-Match", `"v2"`, 0},
+		{"GET", "If-None-Match", `*`, http.StatusNotModified},
+		{"POST", "If-None-Match", `"v1"`, http.StatusPreconditionFailed},
+		{"GET", "If-Match", `"v1"`, http.StatusPreconditionFailed},
+		{"GET", "If-Match", `*`, 0},
+		{"GET", "If-Modified-Since", after, http.StatusNotModified},
+		{"GET", "If-Modified-Since", before, 0},
+		{"POST", "If-Modified-Since", after, 0},
+		{"GET", "If-Unmodified-Since", before, http.StatusPreconditionFailed},
+		{"GET", "If-Unmodified-Since", after, 0},
+		{"GET", "If-Modified-Since", "junk", 0},
+	}
+	for _, c := range cases {
+		req := make(http.Header)
+		req.Set(c.Header, c.Value)
+		if status := Preconditions(c.Method, req, 200, res); status != c.Expected {
+			t.Error(c, "should be", c.Expected, "got", status)
+		}
+	}
+	req := make(http.Header)
+	req.Set("If-None-Match", `"v1"`)
+	if status := Preconditions("GET", req, 404, res); status != 0 {
+		t.Error("preconditions should be ignored for non 2xx got", status)
+	}
+	//If-None-Match takes precedence over If-Modified-Since
+	req.Set("If-None-Match", `"v2"`)
+	req.Set("If-Modified-Since", after)
+	if status := Preconditions("GET", req, 200, res); status != 0 {
+		t.Error("If-Modified-Since should be ignored with If-None-Match got", status)
+	}
+}
+
+func Test_MatchETag(t *testing.T) {
+	if !MatchETag(`"a,b", "c"`, `"a,b"`, false) {
+		t.Error("entity-tags containing commas should match")
+	}
+	if MatchETag(`W/"a"`, `"a"`, false) || !MatchETag(`W/"a"`, `"a"`, true) {
+		t.Error("weak entity-tags should only match weakly")
+	}
+	if MatchETag(`"a"`, ``, true) {
+		t.Error("response without ETag should not match")
+	}
+}
@@ -1,7 +1,6 @@
 package gohttpcache
 
 import (
-	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,12 +8,23 @@ import (
 )
 
 type Determiner struct {
-	ispublic          bool  //Is this a public cache?
-	cachablebydefault []int //Statuses that can be treated as cachable by default.
+	ispublic          bool      //Is this a public cache?
+	methods           []string  //Request methods whose responses are cachable.
+	cachablebydefault []int     //Statuses that can be treated as cachable by default.
+	heuristic         Heuristic //Freshness for responses without explicit expiration.
 }
 
-func NewDeterminer(ispublic bool) Determiner {
-	return Determiner{ispublic: ispublic, cachablebydefault: []int{200, 404}}
+//NewDeterminer creates a Determiner for a shared (public) or private cache.
+//By default GET and HEAD are cachable, along with the statuses rfc7231
+//defines as cachable by default.
+func NewDeterminer(ispublic bool, opts ...Option) Determiner {
+	d := Determiner{
+		ispublic:          ispublic,
+		methods:           []string{"GET", "HEAD"},
+		cachablebydefault: HeuristicStatuses,
+		heuristic:         DefaultHeuristic,
+	}
+	return d.With(opts...)
 }
 
 func NewPrivateDeterminer() Determiner {
@@ -25,33 +35,87 @@ func NewPublicDeterminer() Determiner {
 	return NewDeterminer(true)
 }
 
+//Decision is the outcome of Decide. Reasons is an audit trail of the rules
+//that drove the outcome, each prefixed with the rfc7234 section it comes from.
+type Decision struct {
+	Cache      bool          //Response may be reused from cache
+	Store      bool          //Response may be written to non-volatile storage
+	Stale      bool          //Response may be served stale
+	Heuristics bool          //No explicit freshness, lifetime is heuristic
+	TTL        time.Duration //Freshness lifetime
+	Age        time.Duration //Age of the response when it was received
+	Warning    string        //Warning header value to add to the stored response, if any
+	Reasons    []string
+
+	StaleWhileRevalidate time.Duration //Serve stale this long while revalidating, rfc5861
+	StaleIfError         time.Duration //Serve stale this long if origin fails, rfc5861
+
+	NoCacheFields []string //Fields that may not be reused without revalidation
+	PrivateFields []string //Fields a shared cache must not store
+}
+
+//Remaining is how long the response stays fresh from when it was received,
+//taking the Age it arrived with into account.
+func (self Decision) Remaining() time.Duration {
+	if self.TTL <= self.Age {
+		return time.Duration(0)
+	}
+	return self.TTL - self.Age
+}
+
+//because records why a decision was taken.
+func (self *Decision) because(section, reason string) {
+	self.Reasons = append(self.Reasons, "§"+section+": "+reason)
+}
+
 //Determine determines cachability of a request/response pair.
+//It is a shorthand for Decide when the reasons are not needed, ttl is the
+//remaining freshness of a response that was just received.
 func (self *Determiner) Determine(reqmethod string, respstatus int, reqhdrs, reshdrs http.Header) (cache, store, stale, heuristics bool, ttl time.Duration, err error) {
+	d := self.Decide(reqmethod, respstatus, reqhdrs, reshdrs)
+	return d.Cache, d.Store, d.Stale, d.Heuristics, d.Remaining(), nil
+}
+
+//Decide determines cachability of a request/response pair and explains why.
+func (self *Determiner) Decide(reqmethod string, respstatus int, reqhdrs, reshdrs http.Header) (d Decision) {
 	//Section 3..A cache MUST NOT store a response to any request, unless
 	//The request method is understood by the cache and defined as being cacheable.
-	// TODO: Currently hardcoding this to GET only, needs to be configurable
-	if reqmethod != "GET" {
+	if !self.ismethodcachable(reqmethod) {
+		d.because("3", "method "+reqmethod+" is not cacheable")
 		return
 	}
 	//The response status code is understood by the cache. We assume this
 	// to be the list of status codes understood by net/http/status.go
 	if http.StatusText(respstatus) == "" {
+		d.because("3", "status "+strconv.Itoa(respstatus)+" is not understood")
 		return
 	}
 	cachecontrol := reshdrs[http.CanonicalHeaderKey("Cache-Control")] //The Cache-Control header. Keep for future
-	for _, c := range cachecontrol {
-		// the "no-store" cache directive (see Section 5.2) does not appear
-		// in request or response header fields
-		if strings.Contains(c, "no-store") {
+	cc := ParseCacheControl(cachecontrol)
+	// the "no-store" cache directive (see Section 5.2) does not appear
+	// in request or response header fields
+	if cc.Has("no-store") {
+		d.because("3", "no-store in response")
+		return
+	}
+	if ParseRequestPolicy(reqhdrs).NoStore {
+		d.because("3", "no-store in request")
+		return
+	}
+	//Section 4.1, a Vary field value of "*" always fails to match, so
+	//storing the response is pointless.
+	if varyall(reshdrs) {
+		d.because("4.1", "Vary: * never matches a request")
+		return
+	}
+	if self.ispublic {
+		// the "private" response directive (see Section 5.2.2.6) does not
+		// appear in the response, if the cache is shared. A private
+		// directive qualified with field names only hides those fields.
+		if _, qualified := cc.Fields("private"); cc.Has("private") && !qualified {
+			d.because("3", "private in shared cache")
 			return
 		}
-		if self.ispublic {
-			// the "private" response directive (see Section 5.2.2.6) does not
-			// appear in the response, if the cache is shared
-			if strings.Contains(c, "private") {
-				return
-			}
-		}
 	}
 	if self.ispublic {
 		//the Authorization header field (see Section 4.2 of [RFC7235]) does
@@ -61,46 +125,50 @@ func (self *Determiner) Determine(reqmethod string, respstatus int, reqhdrs, res
 			//Auth hdr is present .. and is shared cache... - Section 3.2 check
 			//tl;dr cache only if explicitly allowed by must-revalidate,
 			//public, and s-maxage.
-			//TODO: Actually implement this. For now we treat auth hrd to be uncachable
-			return
+			if !allowsauthorized(cc) {
+				d.because("3.2", "Authorization in request to shared cache")
+				return
+			}
+			d.because("3.2", "Authorization in request explicitly allowed by response")
 		}
 	}
 	// Atleast 1 of last 6 sub-bullet points must be met for caching to continue
 	var allowcache bool
 	//contains an Expires header field
 	_, allowcache = reshdrs[http.CanonicalHeaderKey("Expires")]
-	for _, c := range cachecontrol {
-		//contains a max-age response directive
-		if strings.Contains(c, "max-age") {
-			allowcache = true
-		}
-		//contains a s-maxage response directive and the cache is shared
-		if self.ispublic {
-			if strings.Contains(c, "s-maxage") {
-				allowcache = true
-			}
-		}
-		//contains a public response directive
-		if strings.Contains(c, "public") {
-			allowcache = true
-		}
+	//contains a max-age response directive
+	if cc.Has("max-age") {
+		allowcache = true
+	}
+	//contains a s-maxage response directive and the cache is shared
+	if self.ispublic && cc.Has("s-maxage") {
+		allowcache = true
+	}
+	//contains a public response directive
+	if cc.Has("public") {
+		allowcache = true
 	}
 	//contains a Cache Control Extension (see Section 5.2.3) that
 	//allows it to be cached
 	// ^ we ignore this
 	//has a status code that is defined as cacheable by default
-	for _, s := range self.cachablebydefault {
-		if respstatus == s {
-			allowcache = true
-		}
+	if self.isheuristicstatus(respstatus) {
+		allowcache = true
 	}
 	if !allowcache {
+		d.because("3", "no explicit freshness and status "+strconv.Itoa(respstatus)+" is not cacheable by default")
+		return
+	}
+	//rfc7231 section 4.3.3 responses to POST are only cachable with
+	//explicit freshness information.
+	if reqmethod == "POST" && !hasexplicitfreshness(self.ispublic, cc, reshdrs) {
+		d.because("3", "POST response without explicit freshness")
 		return
 	}
 
-	cache = true //From here on, a request is cachable.
-	store = true
-	stale = true
+	d.Cache = true //From here on, a request is cachable.
+	d.Store = true
+	d.Stale = true
 	//4.2.1.  Calculating Freshness Lifetime
 	// Date header is needed to calculate freshness from origin.
 	// rfc7231 section 7.1.1.2 clarifies recipient with a clock uses
@@ -108,147 +176,201 @@ func (self *Determiner) Determine(reqmethod string, respstatus int, reqhdrs, res
 
 	var date time.Time
 	var err1 error
+	now := time.Now()
 	datehdr, dateok := reshdrs[http.CanonicalHeaderKey("Date")]
 	if dateok {
 		date, err1 = http.ParseTime(datehdr[0])
 		if err1 != nil {
-			date = time.Now()
+			date = now
 		}
 	} else {
-		date = time.Now()
+		date = now
 	}
-	ttltmp, err1 := getmaxageval(self.ispublic, cachecontrol)
-	if err1 == nil {
-		//TODO: Take Age header value into account! section 5.1
-		ttl = time.Duration(ttltmp) * time.Second
+	//4.2.3.  Calculating Age. We only see the response as it arrives, so
+	//request and response time are both now.
+	d.Age = CurrentAge(reshdrs, now, now, now)
+	if d.Age > 0 {
+		d.because("4.2.3", "response is already "+FormatAge(d.Age)+"s old")
+	}
+	ttltmp, err1 := getmaxageval(self.ispublic, cc)
+	if err1 != ErrDirectiveMissing {
+		//An invalid or conflicting value means the response is already stale.
+		if err1 == nil {
+			d.TTL = time.Duration(ttltmp) * time.Second
+			d.because("4.2.1", "freshness lifetime from max-age/s-maxage")
+		} else {
+			d.because("4.2.1", "invalid max-age/s-maxage, treating as stale")
+		}
 	} else {
 		//Look for expiry header
 		expiry, expiryok := reshdrs[http.CanonicalHeaderKey("Expires")]
 		if expiryok {
-			expires, err1 := http.ParseTime(expiry[0])
-			ttl = expires.Sub(date)
-			if err1 != nil {
-				// Use Heuristics 4.2.2
-				heuristics = true
-			}
+			d.TTL = getexpiresval(expiry, date)
+			d.because("4.2.1", "freshness lifetime from Expires")
 		} else {
-			//Use Heuristics 4.2.2
-			heuristics = true
+			//Use Heuristics 4.2.2. Only allowed for statuses that are
+			//heuristically cacheable, or if explicitly marked public.
+			if self.isheuristicstatus(respstatus) || cc.Has("public") {
+				d.Heuristics = true
+				d.TTL = self.heuristic.Lifetime(reshdrs, date)
+				d.because("4.2.2", "heuristic freshness")
+			} else {
+				d.because("4.2.2", "status "+strconv.Itoa(respstatus)+" is not heuristically cacheable")
+			}
 		}
 	}
 	//Skipping until 5.2.2 because other stuff relates to handling request/responses
 	// Section 5.2.2 Response Cache-Control Directives
-	// TODO : Dear future me, find a proper parser to extract directives.
 
 	// 5.2.2.1 must-revalidate  - no stale
-	if directiveincc(cachecontrol, "must-revalidate") {
-		stale = false
+	if cc.Has("must-revalidate") {
+		d.Stale = false
+		d.because("5.2.2.1", "must-revalidate forbids serving stale")
 	}
 
 	// 5.2.2.2 no-cache .
-	// Simple version without arguments, cache, but set ttl to 0 and dont allow stale.
-	// Actual version, look for field names and handle them accordingly and dont mangle ttl.
-	// TODO: Actually implement actual version
-	if directiveincc(cachecontrol, "no-cache") {
-		ttl = time.Duration(0)
-		stale = false
-	}
-	// 5.2.2.3 no-store.
-	// This is somewhat confusing and open to interpretation.
-	// "the cache MUST NOT intentionally store the information in non-volatile storage"
-	// For our case we will set store to false but let cache be true.
-	// tl;dr allow this to be stored in memory, but not permanent storage?
-	if directiveincc(cachecontrol, "no-store") {
-		store = false
+	// Without arguments, cache, but set ttl to 0 and dont allow stale.
+	// With field names, only those fields may not be reused without
+	// revalidation, the rest of the response is cached as usual.
+	if fields, qualified := cc.Fields("no-cache"); qualified {
+		d.NoCacheFields = fields
+		d.because("5.2.2.2", "no-cache restricted to "+strings.Join(fields, ", "))
+	} else if cc.Has("no-cache") {
+		d.TTL = time.Duration(0)
+		d.Stale = false
+		d.because("5.2.2.2", "no-cache requires revalidation")
 	}
+	// 5.2.2.3 no-store. Never gets here, see section 3 above.
 	//5.2.2.4.  no-transform
 	//We do nothing with it for now. Transformers need to determine this on their own.
 	//5.2.2.5.  public
 	//If public is present, request is cachable even if its normally not!
-	if directiveincc(cachecontrol, "public") {
-		cache = true
-		store = true
+	if cc.Has("public") {
+		d.Cache = true
+		d.Store = true
 	}
 	// 5.2.2.6.  private
-	// Simple version, if present, public cache may not cache or store response.
-	// Actual version, if field names are present then simply hide them.
-	// TODO: Implement the actual version.
-	if self.ispublic && directiveincc(cachecontrol, "private") {
-		cache = false
-		store = false
+	// Without arguments, public cache may not cache or store response.
+	// With field names, public cache must hide those fields.
+	if fields, qualified := cc.Fields("private"); self.ispublic && qualified {
+		d.PrivateFields = fields
+		d.because("5.2.2.6", "private restricted to "+strings.Join(fields, ", "))
+	} else if self.ispublic && cc.Has("private") {
+		d.Cache = false
+		d.Store = false
 	}
 	//5.2.2.7.  proxy-revalidate. Just like must-revalidate but applies only to shared cache.
-	if self.ispublic && directiveincc(cachecontrol, "proxy-revalidate") {
-		stale = false
+	if self.ispublic && cc.Has("proxy-revalidate") {
+		d.Stale = false
+		d.because("5.2.2.7", "proxy-revalidate forbids serving stale from shared cache")
 	}
 	//5.2.2.8.  max-age and 5.2.2.9.  s-maxage implemented while calculating ttl
+	//5.2.3.  Cache Control Extensions. We understand stale-while-revalidate
+	//and stale-if-error from rfc5861, unless serving stale is forbidden.
+	if d.Stale {
+		d.StaleWhileRevalidate, d.StaleIfError = stalewindows(self.ispublic, cc)
+		if d.StaleWhileRevalidate > 0 {
+			d.because("5.2.3", "stale-while-revalidate allows serving stale for "+FormatAge(d.StaleWhileRevalidate)+"s while revalidating")
+		}
+		if d.StaleIfError > 0 {
+			d.because("5.2.3", "stale-if-error allows serving stale for "+FormatAge(d.StaleIfError)+"s on errors")
+		}
+	}
 	//5.4.  Pragma
 	// Pragma is looked at only if cache-control is missing.
 	if len(cachecontrol) == 0 {
 		pragma, pragmaok := reshdrs[http.CanonicalHeaderKey("Pragma")]
 		if pragmaok {
-			if directiveincc(pragma, "no-cache") {
+			if ParsePragma(pragma).Has("no-cache") {
 				//no-cache appears in pragma, so dont cache.
-				cache = false
-				store = false
+				d.Cache = false
+				d.Store = false
+				d.because("5.4", "Pragma: no-cache without Cache-Control")
 			}
 		}
 	}
+	//5.5.4.  Warning 113. We might serve this response past 24 hours
+	//based on heuristics alone.
+	if d.Heuristics && d.TTL > 24*time.Hour {
+		d.Warning = HeuristicWarning
+		d.because("5.5.4", "heuristic freshness exceeds 24 hours")
+	}
 	//progress http://tools.ietf.org/html/rfc7234#section-5.5
 	return
 }
 
-//directiveincc checks if any of the headers contain a particular directive or not.
-func directiveincc(cachecontrol []string, directive string) (present bool) {
-	for _, c := range cachecontrol {
-		if strings.Contains(c, directive) {
-			present = true
-			return
+//isheuristicstatus checks if a status is heuristically cacheable, i.e. cachable by default
+func (self *Determiner) isheuristicstatus(status int) bool {
+	for _, s := range self.cachablebydefault {
+		if status == s {
+			return true
 		}
 	}
-	return
+	return false
 }
 
-func getmaxageval(ispublic bool, cachecontrol []string) (maxage int, err error) {
-	//TODO: this is a major clusterfuck, refactor later after writing tests
-	if ispublic {
-		for _, c := range cachecontrol {
-			if strings.Contains(c, "s-maxage") {
-				for _, smax := range strings.Split(c, ",") {
-					if strings.Contains(smax, "s-maxage") {
-						ttlsplitted := strings.Split(smax, "=")
-						if len(ttlsplitted) != 2 {
-							err = errors.New("Error parsing s-maxage")
-							return
-						} else {
-							ttlstr := strings.TrimSpace(ttlsplitted[1])
-							maxage, err = strconv.Atoi(ttlstr)
-							return
-						}
-					}
-				}
-				return
-			}
+//ismethodcachable checks if responses to a request method may be cached
+func (self *Determiner) ismethodcachable(method string) bool {
+	for _, m := range self.methods {
+		if method == m {
+			return true
 		}
 	}
-	for _, c := range cachecontrol {
-		if strings.Contains(c, "max-age") {
-			for _, smax := range strings.Split(c, ",") {
-				if strings.Contains(smax, "max-age") {
-					ttlsplitted := strings.Split(smax, "=")
-					if len(ttlsplitted) != 2 {
-						err = errors.New("Error parsing max-age")
-						return
-					} else {
-						ttlstr := strings.TrimSpace(ttlsplitted[1])
-						maxage, err = strconv.Atoi(ttlstr)
-						return
-					}
-				}
+	return false
+}
+
+//varyall checks if Vary lists "*"
+func varyall(reshdrs http.Header) bool {
+	for _, v := range reshdrs[http.CanonicalHeaderKey("Vary")] {
+		for _, field := range strings.Split(v, ",") {
+			if strings.TrimSpace(field) == "*" {
+				return true
 			}
+		}
+	}
+	return false
+}
+
+//allowsauthorized checks if a shared cache may store the response to a
+//request that carries Authorization, as per section 3.2
+func allowsauthorized(cc CacheControl) bool {
+	return cc.Has("must-revalidate") || cc.Has("public") || cc.Has("s-maxage")
+}
+
+//hasexplicitfreshness checks for an explicit expiration time as per section 4.2.1
+func hasexplicitfreshness(ispublic bool, cc CacheControl, reshdrs http.Header) bool {
+	if _, ok := reshdrs[http.CanonicalHeaderKey("Expires")]; ok {
+		return true
+	}
+	return cc.Has("max-age") || (ispublic && cc.Has("s-maxage"))
+}
+
+//getmaxageval returns the s-maxage (for shared caches) or max-age value in
+//seconds. ErrDirectiveMissing means neither is present, any other error means
+//the value is invalid as per section 4.2.1.
+func getmaxageval(ispublic bool, cc CacheControl) (maxage int64, err error) {
+	if ispublic && cc.Has("s-maxage") {
+		return cc.Seconds("s-maxage")
+	}
+	return cc.Seconds("max-age")
+}
+
+//getexpiresval computes freshness lifetime from Expires header values.
+//Conflicting or invalid values (such as "0") are treated as already expired,
+//as per sections 4.2.1 and 5.3.
+func getexpiresval(expiry []string, date time.Time) (ttl time.Duration) {
+	for _, e := range expiry[1:] {
+		if e != expiry[0] {
 			return
 		}
 	}
-	err = errors.New("s-maxage or max-age not found")
+	expires, err := http.ParseTime(expiry[0])
+	if err != nil {
+		return
+	}
+	ttl = expires.Sub(date)
+	if ttl < 0 {
+		ttl = time.Duration(0)
+	}
 	return
 }
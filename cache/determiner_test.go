@@ -95,3 +95,212 @@ func Test_PublicDeterminer(t *testing.T) {
 	}
 	dt.runtest(t)
 }
+
+func Test_DecideReasons(t *testing.T) {
+	req := make(http.Header)
+	res := make(http.Header)
+	res.Set("Cache-Control", "private, max-age=60")
+	pub := NewPublicDeterminer()
+	d := pub.Decide("GET", 200, req, res)
+	if d.Cache || len(d.Reasons) != 1 || d.Reasons[0] != "§3: private in shared cache" {
+		t.Error("private response in shared cache should be rejected by §3 got", d)
+	}
+	pri := NewPrivateDeterminer()
+	d = pri.Decide("GET", 200, req, res)
+	if !d.Cache || len(d.Reasons) != 1 || d.Reasons[0] != "§4.2.1: freshness lifetime from max-age/s-maxage" {
+		t.Error("private response in private cache should be fresh per §4.2.1 got", d)
+	}
+	res = make(http.Header)
+	d = pri.Decide("GET", 200, req, res)
+	if !d.Heuristics || d.Reasons[len(d.Reasons)-1] != "§4.2.2: heuristic freshness" {
+		t.Error("response without freshness should use §4.2.2 heuristics got", d)
+	}
+}
+
+func Test_HeuristicFreshness(t *testing.T) {
+	//Date slightly ahead of us so the apparent age is zero.
+	date := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	res := make(http.Header)
+	res.Set("Date", date.Format(http.TimeFormat))
+	res.Set("Last-Modified", date.Add(-100*time.Hour).Format(http.TimeFormat))
+	dt := &DeterminerTestCase{
+		200,
+		"GET",
+		make(http.Header),
+		res,
+		DeterminerExpected{true, true, true, true, time.Duration(10) * time.Hour, nil},
+		DeterminerExpected{true, true, true, true, time.Duration(10) * time.Hour, nil},
+		"10% of time since Last-Modified",
+	}
+	dt.runtest(t)
+
+	res.Set("Last-Modified", date.Add(-1000*time.Hour).Format(http.TimeFormat))
+	pub := NewPublicDeterminer()
+	d := pub.Decide("GET", 200, make(http.Header), res)
+	if d.TTL != 100*time.Hour || d.Warning != HeuristicWarning {
+		t.Error("heuristic over 24h should carry Warning 113 got", d)
+	}
+	pub = pub.With(WithHeuristic(Heuristic{Fraction: 0.5, Min: time.Minute, Max: 48 * time.Hour}))
+	if d = pub.Decide("GET", 200, make(http.Header), res); d.TTL != 48*time.Hour {
+		t.Error("heuristic should be clamped to Max 48h got", d.TTL)
+	}
+	res.Del("Last-Modified")
+	if d = pub.Decide("GET", 200, make(http.Header), res); d.TTL != time.Minute || d.Warning != "" {
+		t.Error("heuristic without Last-Modified should be Min 1m got", d)
+	}
+	res.Set("Cache-Control", "public")
+	if d = pub.Decide("GET", 302, make(http.Header), res); !d.Heuristics || d.TTL != time.Minute {
+		t.Error("public 302 may use heuristics got", d)
+	}
+	res.Set("Cache-Control", "max-age=60")
+	if d = pub.Decide("GET", 302, make(http.Header), res); d.Heuristics {
+		t.Error("explicit freshness must not use heuristics got", d)
+	}
+}
+
+func Test_DefaultMethods(t *testing.T) {
+	res := http.Header{"Cache-Control": []string{"max-age=60"}}
+	for _, d := range []Determiner{NewPublicDeterminer(), NewPrivateDeterminer()} {
+		for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"} {
+			cachable := method == "GET" || method == "HEAD"
+			if decision := d.Decide(method, 200, make(http.Header), res); decision.Cache != cachable {
+				t.Error(method, "cachable should be", cachable, "by default got", decision)
+			}
+		}
+	}
+}
+
+func Test_DeterminerOptions(t *testing.T) {
+	res := make(http.Header)
+	pub := NewPublicDeterminer()
+	if d := pub.Decide("HEAD", 410, make(http.Header), res); !d.Cache {
+		t.Error("410 to HEAD should be cachable by default got", d)
+	}
+	if d := pub.Decide("POST", 200, make(http.Header), res); d.Cache {
+		t.Error("POST should not be cachable by default got", d)
+	}
+	post := pub.With(WithMethods("get", "post"))
+	if d := post.Decide("POST", 200, make(http.Header), res); d.Cache {
+		t.Error("POST without explicit freshness should not be cachable got", d)
+	}
+	res.Set("Cache-Control", "max-age=60")
+	if d := post.Decide("POST", 200, make(http.Header), res); !d.Cache || d.TTL != time.Minute {
+		t.Error("POST with max-age should be cachable got", d)
+	}
+	if d := post.Decide("HEAD", 200, make(http.Header), res); d.Cache {
+		t.Error("HEAD should not be cachable when methods are overridden got", d)
+	}
+	if d := pub.Decide("POST", 200, make(http.Header), res); d.Cache {
+		t.Error("With should not modify the original Determiner got", d)
+	}
+	res.Del("Cache-Control")
+	only200 := NewDeterminer(true, WithCachableStatuses(200))
+	if d := only200.Decide("GET", 404, make(http.Header), res); d.Cache {
+		t.Error("404 should not be cachable by default when overridden got", d)
+	}
+	private200 := only200.With(WithShared(false))
+	if d := private200.Decide("GET", 200, make(http.Header), res); !d.Cache {
+		t.Error("200 should still be cachable got", d)
+	}
+}
+
+func Test_AuthorizationSharedCache(t *testing.T) {
+	req := make(http.Header)
+	req.Set("Authorization", "Bearer foo")
+	res := make(http.Header)
+	res.Set("Cache-Control", "max-age=60")
+	dt := &DeterminerTestCase{
+		200,
+		"GET",
+		req,
+		res,
+		DeterminerExpected{false, false, false, false, time.Duration(0), nil},
+		DeterminerExpected{true, true, true, false, time.Duration(60) * time.Second, nil},
+		"Authorization without explicit permission is not shared",
+	}
+	dt.runtest(t)
+
+	for _, cc := range []string{"public, max-age=60", "must-revalidate, max-age=60", "s-maxage=60"} {
+		res.Set("Cache-Control", cc)
+		pub := NewPublicDeterminer()
+		if d := pub.Decide("GET", 200, req, res); !d.Cache || d.TTL != time.Minute {
+			t.Error(cc, "should allow shared caching of authorized response got", d)
+		}
+	}
+}
+
+func Test_QualifiedNoCachePrivate(t *testing.T) {
+	res := make(http.Header)
+	res.Set("Cache-Control", `max-age=60, no-cache="Set-Cookie", private="X-User"`)
+	dt := &DeterminerTestCase{
+		200,
+		"GET",
+		make(http.Header),
+		res,
+		DeterminerExpected{true, true, true, false, time.Duration(60) * time.Second, nil},
+		DeterminerExpected{true, true, true, false, time.Duration(60) * time.Second, nil},
+		"qualified no-cache and private only affect the named fields",
+	}
+	dt.runtest(t)
+
+	pub := NewPublicDeterminer()
+	d := pub.Decide("GET", 200, make(http.Header), res)
+	if len(d.NoCacheFields) != 1 || d.NoCacheFields[0] != "Set-Cookie" || len(d.PrivateFields) != 1 || d.PrivateFields[0] != "X-User" {
+		t.Error("public determiner should report Set-Cookie and X-User got", d)
+	}
+	pri := NewPrivateDeterminer()
+	if d = pri.Decide("GET", 200, make(http.Header), res); len(d.PrivateFields) != 0 {
+		t.Error("private determiner should not hide private fields got", d)
+	}
+	if len(d.NoCacheFields) != 1 {
+		t.Error("private determiner should still report no-cache fields got", d)
+	}
+}
+
+func Test_StaleExtensions(t *testing.T) {
+	req := make(http.Header)
+	res := make(http.Header)
+	res.Set("Cache-Control", "max-age=60, stale-while-revalidate=30, stale-if-error=86400")
+	pub := NewPublicDeterminer()
+	d := pub.Decide("GET", 200, req, res)
+	if d.StaleWhileRevalidate != 30*time.Second || d.StaleIfError != 24*time.Hour {
+		t.Error("stale-while-revalidate and stale-if-error should be honored got", d)
+	}
+	if d.Reasons[len(d.Reasons)-1] != "§5.2.3: stale-if-error allows serving stale for 86400s on errors" {
+		t.Error("stale-if-error should be explained got", d.Reasons)
+	}
+	res.Set("Cache-Control", "max-age=60, must-revalidate, stale-while-revalidate=30, stale-if-error=60")
+	d = pub.Decide("GET", 200, req, res)
+	if d.StaleWhileRevalidate != 0 || d.StaleIfError != 0 {
+		t.Error("must-revalidate should override stale extensions got", d)
+	}
+	res.Set("Cache-Control", "max-age=60, proxy-revalidate, stale-if-error=60")
+	if d = pub.Decide("GET", 200, req, res); d.StaleWhileRevalidate != 0 || d.StaleIfError != 0 {
+		t.Error("proxy-revalidate should override stale extensions in shared cache got", d)
+	}
+	pri := NewPrivateDeterminer()
+	if d = pri.Decide("GET", 200, req, res); d.StaleIfError != time.Minute {
+		t.Error("proxy-revalidate should not apply to private cache got", d)
+	}
+	res.Set("Cache-Control", "max-age=60, stale-while-revalidate=abc")
+	if d = pub.Decide("GET", 200, req, res); d.StaleWhileRevalidate != 0 {
+		t.Error("invalid stale-while-revalidate should be ignored got", d)
+	}
+}
+
+func Test_VaryAll(t *testing.T) {
+	req := make(http.Header)
+	res := make(http.Header)
+	res.Set("Cache-Control", "max-age=60")
+	res.Set("Vary", "Accept-Encoding, *")
+	pub := NewPublicDeterminer()
+	d := pub.Decide("GET", 200, req, res)
+	if d.Cache || d.Reasons[0] != "§4.1: Vary: * never matches a request" {
+		t.Error("Vary: * should not be cacheable got", d)
+	}
+	res.Set("Vary", "Accept-Encoding")
+	d = pub.Decide("GET", 200, req, res)
+	if !d.Cache {
+		t.Error("Vary without * should be cacheable got", d)
+	}
+}
@@ -0,0 +1,43 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"time"
+)
+
+//Warning added to responses whose heuristic freshness exceeds 24 hours,
+//rfc7234 section 5.5.4
+const HeuristicWarning = `113 - "Heuristic Expiration"`
+
+//Status codes defined as cacheable by default (heuristically cacheable) in
+//rfc7231 section 6.1
+var HeuristicStatuses = []int{200, 203, 204, 206, 300, 301, 404, 405, 410, 414, 501}
+
+//Heuristic configures freshness for responses without explicit expiration,
+//as per rfc7234 section 4.2.2. Lifetime is a Fraction of the time between
+//Date and Last-Modified, clamped to [Min, Max]. A zero Max means no upper
+//bound.
+type Heuristic struct {
+	Fraction float64
+	Min      time.Duration
+	Max      time.Duration
+}
+
+//The typical 10% suggested by the rfc, capped at a week.
+var DefaultHeuristic = Heuristic{Fraction: 0.1, Max: 7 * 24 * time.Hour}
+
+//Lifetime computes the heuristic freshness lifetime of a response. date is
+//the response Date, or the time it was received if Date is missing.
+func (self Heuristic) Lifetime(reshdrs http.Header, date time.Time) (ttl time.Duration) {
+	lastmodified, err := http.ParseTime(reshdrs.Get("Last-Modified"))
+	if err == nil && date.After(lastmodified) {
+		ttl = time.Duration(float64(date.Sub(lastmodified)) * self.Fraction)
+	}
+	if ttl < self.Min {
+		ttl = self.Min
+	}
+	if self.Max > 0 && ttl > self.Max {
+		ttl = self.Max
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package gohttpcache
+
+import (
+	"strings"
+)
+
+//Option configures a Determiner, see NewDeterminer and Determiner.With
+type Option func(*Determiner)
+
+//WithMethods sets the request methods whose responses may be cached.
+//Responses to POST are still only cached with explicit freshness, and may
+//only answer later GET and HEAD requests, rfc7231 section 4.3.3. A POST
+//itself must always be forwarded, see rfc7234 section 4.4.
+func WithMethods(methods ...string) Option {
+	return func(self *Determiner) {
+		self.methods = make([]string, len(methods))
+		for i, m := range methods {
+			self.methods[i] = strings.ToUpper(m)
+		}
+	}
+}
+
+//WithCachableStatuses sets the statuses that are cachable by default, i.e.
+//cachable without explicit freshness, using heuristics.
+func WithCachableStatuses(statuses ...int) Option {
+	return func(self *Determiner) {
+		self.cachablebydefault = append([]int(nil), statuses...)
+	}
+}
+
+//WithHeuristic sets how heuristic freshness is computed.
+func WithHeuristic(heuristic Heuristic) Option {
+	return func(self *Determiner) {
+		self.heuristic = heuristic
+	}
+}
+
+//WithShared sets whether the Determiner is for a shared (public) cache.
+func WithShared(ispublic bool) Option {
+	return func(self *Determiner) {
+		self.ispublic = ispublic
+	}
+}
+
+//With returns a copy of the Determiner with opts applied, leaving the
+//original untouched. Useful for per-service overrides of a common policy.
+func (self Determiner) With(opts ...Option) Determiner {
+	for _, opt := range opts {
+		opt(&self)
+	}
+	return self
+}
@@ -0,0 +1,74 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"time"
+)
+
+//RequestPolicy holds the request Cache-Control directives of rfc7234 section
+//5.2.1 that constrain what a cache may serve for a request.
+type RequestPolicy struct {
+	NoCache      bool          //Stored responses must not be used without revalidation
+	NoStore      bool          //Neither request nor response may be stored
+	OnlyIfCached bool          //Client only wants a stored response, or a 504
+	MaxAge       time.Duration //Oldest acceptable response, if HasMaxAge
+	HasMaxAge    bool
+	MaxStale     time.Duration //How far past expiry the client accepts, if HasMaxStale
+	HasMaxStale  bool          //max-stale present, without argument any staleness is accepted
+	MinFresh     time.Duration //Response must stay fresh for at least this long
+}
+
+//ParseRequestPolicy extracts the request directives. As per section 5.4 a
+//Pragma: no-cache is honored only when Cache-Control is missing. Directives
+//with invalid arguments are ignored, except max-stale which then accepts any
+//staleness like its argument-less form.
+func ParseRequestPolicy(reqhdrs http.Header) (policy RequestPolicy) {
+	cachecontrol := reqhdrs[http.CanonicalHeaderKey("Cache-Control")]
+	if len(cachecontrol) == 0 {
+		policy.NoCache = ParsePragma(reqhdrs[http.CanonicalHeaderKey("Pragma")]).Has("no-cache")
+		return
+	}
+	cc := ParseCacheControl(cachecontrol)
+	policy.NoCache = cc.Has("no-cache")
+	policy.NoStore = cc.Has("no-store")
+	policy.OnlyIfCached = cc.Has("only-if-cached")
+	if secs, err := cc.Seconds("max-age"); err == nil {
+		policy.MaxAge = time.Duration(secs) * time.Second
+		policy.HasMaxAge = true
+	}
+	if secs, err := cc.Seconds("min-fresh"); err == nil {
+		policy.MinFresh = time.Duration(secs) * time.Second
+	}
+	if cc.Has("max-stale") {
+		policy.HasMaxStale = true
+		policy.MaxStale = maxdeltaseconds * time.Second
+		if secs, err := cc.Seconds("max-stale"); err == nil {
+			policy.MaxStale = time.Duration(secs) * time.Second
+		}
+	}
+	return
+}
+
+//Acceptable checks if a stored response with the given freshness lifetime
+//and current age may be served for this request as per section 4.2 and
+//5.2.1. mustrevalidate is set when the response forbids serving it stale,
+//which overrides max-stale.
+func (self RequestPolicy) Acceptable(lifetime, age time.Duration, mustrevalidate bool) bool {
+	if self.NoCache {
+		return false
+	}
+	if self.HasMaxAge && age > self.MaxAge {
+		return false
+	}
+	if self.MinFresh > 0 && lifetime-age < self.MinFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	//Stale from here on
+	if mustrevalidate || !self.HasMaxStale {
+		return false
+	}
+	return age-lifetime <= self.MaxStale
+}
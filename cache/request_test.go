@@ -0,0 +1,66 @@
+package gohttpcache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+type RequestPolicyTestCase struct {
+	CacheControl   string
+	Lifetime       time.Duration
+	Age            time.Duration
+	MustRevalidate bool
+	Acceptable     bool
+}
+
+func Test_RequestPolicyAcceptable(t *testing.T) {
+	cases := []RequestPolicyTestCase{
+		{"", time.Minute, 30 * time.Second, false, true},
+		{"", time.Minute, 90 * time.Second, false, false},
+		{"no-cache", time.Minute, 0, false, false},
+		{"max-age=10", time.Minute, 30 * time.Second, false, false},
+		{"max-age=60", time.Minute, 30 * time.Second, false, true},
+		{"min-fresh=40", time.Minute, 30 * time.Second, false, false},
+		{"min-fresh=20", time.Minute, 30 * time.Second, false, true},
+		{"max-stale", time.Minute, time.Hour, false, true},
+		{"max-stale=60", time.Minute, 90 * time.Second, false, true},
+		{"max-stale=10", time.Minute, 90 * time.Second, false, false},
+		{"max-stale=60", time.Minute, 90 * time.Second, true, false},
+		{"max-stale=junk", time.Minute, time.Hour, false, true},
+	}
+	for _, c := range cases {
+		req := make(http.Header)
+		if c.CacheControl != "" {
+			req.Set("Cache-Control", c.CacheControl)
+		}
+		policy := ParseRequestPolicy(req)
+		if ok := policy.Acceptable(c.Lifetime, c.Age, c.MustRevalidate); ok != c.Acceptable {
+			t.Error(c, "acceptable should be", c.Acceptable, "got", ok)
+		}
+	}
+}
+
+func Test_RequestPolicyParse(t *testing.T) {
+	req := make(http.Header)
+	req.Set("Pragma", "no-cache")
+	if policy := ParseRequestPolicy(req); !policy.NoCache {
+		t.Error("Pragma: no-cache without Cache-Control should be no-cache")
+	}
+	req.Set("Cache-Control", "only-if-cached, no-store")
+	policy := ParseRequestPolicy(req)
+	if policy.NoCache || !policy.NoStore || !policy.OnlyIfCached {
+		t.Error("Cache-Control should take precedence over Pragma got", policy)
+	}
+	pub := NewPublicDeterminer()
+	res := make(http.Header)
+	res.Set("Cache-Control", "max-age=60")
+	if d := pub.Decide("GET", 200, req, res); d.Cache || d.Store {
+		t.Error("request no-store should not be cached got", d)
+	}
+	res.Set("Cache-Control", "max-age=60, proxy-revalidate")
+	pri := NewPrivateDeterminer()
+	if pub.Decide("GET", 200, nil, res).Stale || !pri.Decide("GET", 200, nil, res).Stale {
+		t.Error("proxy-revalidate only applies to shared caches")
+	}
+}
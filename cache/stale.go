@@ -0,0 +1,31 @@
+package gohttpcache
+
+import (
+	"time"
+)
+
+//Warnings for stale responses, rfc7234 sections 5.5.1 and 5.5.2
+const (
+	StaleWarning              = `110 - "Response is Stale"`
+	RevalidationFailedWarning = `111 - "Revalidation Failed"`
+)
+
+//stalewindows returns how long past its freshness lifetime a response may
+//be served while it is revalidated in the background, and when revalidation
+//fails, as per the rfc5861 stale-while-revalidate and stale-if-error
+//extensions. Both are zero if the response may not be served stale at all.
+func stalewindows(ispublic bool, cc CacheControl) (whilerevalidate, iferror time.Duration) {
+	if cc.Has("must-revalidate") || (ispublic && cc.Has("proxy-revalidate")) {
+		return
+	}
+	if _, qualified := cc.Fields("no-cache"); cc.Has("no-cache") && !qualified {
+		return
+	}
+	if secs, err := cc.Seconds("stale-while-revalidate"); err == nil {
+		whilerevalidate = time.Duration(secs) * time.Second
+	}
+	if secs, err := cc.Seconds("stale-if-error"); err == nil {
+		iferror = time.Duration(secs) * time.Second
+	}
+	return
+}
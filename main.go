@@ -8,21 +8,21 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
-	"time"
 )
 
 var redirecterr = errors.New("redirectionblocked")
 
-func printresponse(ctype string, cache, store, stale, heuristics bool, ttl time.Duration, err error) {
+func printresponse(ctype string, d gohttpcache.Decision) {
 	fmt.Println(ctype)
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Printf("Cachable: %v\n", cache)
-		fmt.Printf("Store: %v\n", store)
-		fmt.Printf("Allow Stale: %v\n", stale)
-		fmt.Printf("Allow heuristics: %v\n", heuristics)
-		fmt.Printf("Cache TTL: %s\n", ttl)
+	fmt.Printf("Cachable: %v\n", d.Cache)
+	fmt.Printf("Store: %v\n", d.Store)
+	fmt.Printf("Allow Stale: %v\n", d.Stale)
+	fmt.Printf("Allow heuristics: %v\n", d.Heuristics)
+	fmt.Printf("Cache TTL: %s\n", d.TTL)
+	fmt.Printf("Age: %s\n", d.Age)
+	fmt.Println("Because:")
+	for _, reason := range d.Reasons {
+		fmt.Printf("  %s\n", reason)
 	}
 }
 
@@ -52,8 +52,6 @@ func main() {
 
 	pub := gohttpcache.NewPublicDeterminer()
 	pri := gohttpcache.NewPrivateDeterminer()
-	cache, store, stale, heuristics, ttl, err := pub.Determine("GET", 200, req.Header, resp.Header)
-	printresponse("public", cache, store, stale, heuristics, ttl, err)
-	cache, store, stale, heuristics, ttl, err = pri.Determine("GET", 200, req.Header, resp.Header)
-	printresponse("private", cache, store, stale, heuristics, ttl, err)
+	printresponse("public", pub.Decide("GET", 200, req.Header, resp.Header))
+	printresponse("private", pri.Decide("GET", 200, req.Header, resp.Header))
 }
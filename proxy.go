@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"github.com/sajal/gohttpcache/cache"
+	"github.com/sajal/gohttpcache/proxy"
 	"github.com/valyala/ybc/bindings/go/ybc"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -84,9 +87,10 @@ func fetchupstream(r *http.Request, origin string) (item *ybc.Item, err error) {
 	defer resp.Body.Close()
 	// load into cache...
 
-	_, _, _, heuristics, ttl, err := determiner.Determine(r.Method, resp.StatusCode, req.Header, resp.Header)
-	if ttl == time.Duration(0) && heuristics {
-		ttl = time.Duration(24) * time.Hour
+	decision := determiner.Decide(r.Method, resp.StatusCode, req.Header, resp.Header)
+	ttl := decision.Remaining()
+	if decision.Warning != "" {
+		resp.Header.Add("Warning", decision.Warning)
 	}
 	if ttl < time.Minute {
 		ttl = time.Minute
@@ -246,22 +250,29 @@ func hosthandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//Reuse the cache files of the last run, see goproxy.OpenYbcCache
+func opencache(name string, size, maxitems int) *ybc.Cache {
+	cache, report, err := goproxy.OpenYbcCache(name, size, maxitems)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(report)
+	return cache
+}
+
 func main() {
+	cachedir := flag.String("cachedir", "/tmp/", "directory for the cache files")
+	metasize := flag.Int("metasize", 64, "size of the metadata cache in MB")
+	objsize := flag.Int("objsize", 500, "size of the object cache in MB")
+	maxitems := flag.Int("maxitems", 500*1000, "max items in each cache")
+	flag.Parse()
 	originmapping = make(map[string]string, 2)
 	originmapping["cdn.cdnplanet.com"] = "www.cdnplanet.com"
 	originmapping["cdn.turbobytes.com"] = "www.turbobytes.com"
 	client = &http.Transport{}
 	determiner = gohttpcache.NewPublicDeterminer()
-	metacacheconfig := ybc.Config{
-		MaxItemsCount: ybc.SizeT(500 * 1000), //500k keys..
-	}
-	metacache, _ = metacacheconfig.OpenCache(true)
-
-	objcacheconfig := ybc.Config{
-		MaxItemsCount: ybc.SizeT(500 * 1000),        //500k keys..
-		DataFileSize:  ybc.SizeT(500 * 1024 * 1024), //500 MB
-	}
-	objcache, _ = objcacheconfig.OpenCache(true)
+	metacache = opencache(filepath.Join(*cachedir, "legacy-meta"), *metasize, *maxitems)
+	objcache = opencache(filepath.Join(*cachedir, "legacy-obj"), *objsize, *maxitems)
 
 	log.Println("Hello Proxy")
 	srv := &http.Server{
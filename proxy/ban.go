@@ -0,0 +1,247 @@
+package goproxy
+
+import (
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//Bans are kept in metacache under this key so they outlive restarts, like
+//the objects they apply to. So is a bound on when the objects stored so far
+//expire, which new bans last until. Encoded as version 2, the bound as a
+//time, a uint count and for each ban host, path, header and value as bytes,
+//then created and expires times, see metacodec.go.
+var bankey = []byte("\x00bans")
+
+const bansversion = 2
+
+//The bound saved is this far past the last expiry seen, so it only has to
+//be saved again once objects outlive it
+const expiryslack = time.Hour
+
+//A ban invalidates every stored object fetched before it that matches it.
+//Bans are checked lazily, when an object is looked up, so they work for
+//things a Store cannot enumerate such as regexes over URLs.
+type ban struct {
+	host    string         //Hostname the request was for, empty for any
+	path    *regexp.Regexp //Matched against the request URI, nil for any
+	header  string         //Response header to match, empty for none
+	value   *regexp.Regexp //Matched against the response header
+	created time.Time
+	expires time.Time //Everything fetched before the ban is gone from cache by then
+}
+
+func (self *ban) matches(host, uri string, meta MetaItem) bool {
+	if !meta.Fetched.Before(self.created) {
+		return false
+	}
+	if self.host != "" && self.host != host {
+		return false
+	}
+	if self.path != nil && !self.path.MatchString(uri) {
+		return false
+	}
+	if self.header != "" && !self.value.MatchString(meta.Header.Get(self.header)) {
+		return false
+	}
+	return true
+}
+
+//Bans oldest first, plus how long stored objects live so bans that can no
+//longer match anything are dropped.
+type banlist struct {
+	mu         sync.RWMutex
+	bans       []*ban
+	lastexpiry time.Time //When the longest lived object stored so far expires
+	saved      time.Time //Bound on lastexpiry in store, never before it
+	store      Store     //Where bans are saved, nil to not save them
+}
+
+//An object was stored that lives until expiry
+func (self *banlist) stored(expiry time.Time) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if expiry.After(self.lastexpiry) {
+		self.lastexpiry = expiry
+	}
+	if self.store != nil && self.lastexpiry.After(self.saved) {
+		//Saved right away, so a crash cannot lose track of what was stored
+		self.saved = self.lastexpiry.Add(expiryslack)
+		self.save()
+	}
+}
+
+func (self *banlist) add(b *ban) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	b.created = time.Now()
+	b.expires = self.lastexpiry
+	self.bans = append(self.bans, b)
+	self.compact(b.created)
+	self.save()
+}
+
+//Must hold the lock
+func (self *banlist) save() {
+	if self.store == nil {
+		return
+	}
+	//Bans never outlast the objects they apply to
+	ttl := time.Until(self.saved)
+	if ttl <= 0 {
+		self.store.Delete(bankey)
+		return
+	}
+	w := &metawriter{buf: []byte{bansversion}}
+	w.time(self.saved)
+	w.uint(uint64(len(self.bans)))
+	for _, b := range self.bans {
+		w.string(b.host)
+		w.string(pattern(b.path))
+		w.string(b.header)
+		w.string(pattern(b.value))
+		w.time(b.created)
+		w.time(b.expires)
+	}
+	err := setvalue(self.store, bankey, w.buf, ttl)
+	if err != nil {
+		log.Println("saving bans", err)
+	}
+}
+
+func pattern(re *regexp.Regexp) string {
+	if re == nil {
+		return ""
+	}
+	return re.String()
+}
+
+//Pick up the bans saved by an earlier run
+func (self *banlist) load() {
+	m, err := getvalue(self.store, bankey)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Println("loading bans", err)
+		}
+		return
+	}
+	bans, saved, err := decodebans(m)
+	if err != nil {
+		log.Println("loading bans", err)
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.bans = bans
+	if saved.After(self.lastexpiry) {
+		self.lastexpiry = saved
+	}
+	if saved.After(self.saved) {
+		self.saved = saved
+	}
+	self.compact(time.Now())
+}
+
+func decodebans(m []byte) (bans []*ban, saved time.Time, err error) {
+	r := &metareader{buf: m}
+	r.version(bansversion)
+	saved = r.time()
+	n := r.count()
+	for i := 0; i < n && r.err == nil; i++ {
+		b := &ban{host: r.string()}
+		path := r.string()
+		b.header = r.string()
+		value := r.string()
+		b.created = r.time()
+		b.expires = r.time()
+		if path != "" {
+			b.path, err = regexp.Compile(path)
+			if err != nil {
+				return
+			}
+		}
+		if b.header != "" {
+			b.value, err = regexp.Compile(value)
+			if err != nil {
+				return
+			}
+		}
+		bans = append(bans, b)
+	}
+	err = r.end()
+	return
+}
+
+//Drop bans older than every object still in cache. Expiry only grows with
+//each ban, so those are always at the front. Must hold the lock.
+func (self *banlist) compact(now time.Time) {
+	i := 0
+	for i < len(self.bans) && self.bans[i].expires.Before(now) {
+		i++
+	}
+	if i > 0 {
+		self.bans = append([]*ban(nil), self.bans[i:]...)
+	}
+}
+
+//Check a stored object against the bans issued after it was fetched
+func (self *banlist) banned(host, uri string, meta MetaItem) bool {
+	now := time.Now()
+	self.mu.RLock()
+	stale := len(self.bans) > 0 && self.bans[0].expires.Before(now)
+	matched := false
+	for i := len(self.bans) - 1; i >= 0 && !matched; i-- {
+		b := self.bans[i]
+		if !meta.Fetched.Before(b.created) {
+			//Older bans cannot apply either
+			break
+		}
+		matched = b.matches(host, uri, meta)
+	}
+	self.mu.RUnlock()
+	if stale {
+		self.mu.Lock()
+		self.compact(now)
+		self.mu.Unlock()
+	}
+	return matched
+}
+
+func (self *banlist) len() int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return len(self.bans)
+}
+
+//Ban invalidates every object stored so far for requests to host (any host
+//if empty) whose URI matches the path regex (any if empty) and whose stored
+//response has a header matching the value regex (skipped if header is empty).
+//Banned objects are evicted when next looked up.
+func (self *ProxyServer) Ban(host, path, header, value string) (err error) {
+	b := &ban{host: host, header: header}
+	if path != "" {
+		b.path, err = regexp.Compile(path)
+		if err != nil {
+			return
+		}
+	}
+	if header != "" {
+		b.value, err = regexp.Compile(value)
+		if err != nil {
+			return
+		}
+	}
+	self.bans.add(b)
+	return
+}
+
+//Evict a looked up object if a ban applies to it
+func (self *ProxyServer) checkbans(req *transaction, meta MetaItem) bool {
+	if !self.bans.banned(req.clientreq.Host, req.clientreq.RequestURI, meta) {
+		return false
+	}
+	req.log("banned")
+	self.purgeobject(req.objkey, false)
+	return true
+}
@@ -0,0 +1,72 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Ban(t *testing.T) {
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Group", strings.Split(r.URL.Path, "/")[1])
+		w.Write([]byte(r.URL.Path))
+	})
+	paths := []string{"/a/1", "/a/2", "/b/1"}
+	expect := func(name string, statuses ...string) {
+		for i, path := range paths {
+			if w := p.get(path); cachestatus(w) != statuses[i] || readbody(w) != path {
+				t.Error(name, path, "should be", statuses[i], "got", cachestatus(w), readbody(w))
+			}
+		}
+	}
+	expect("first fetch", "MISS", "MISS", "MISS")
+	if err := p.Ban("", "^/a/", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect("after path ban", "MISS", "MISS", "HIT")
+	//Fetched after the ban, so not affected by it
+	expect("refetched", "HIT", "HIT", "HIT")
+	p.Ban("", "", "X-Group", "^b$")
+	expect("after header ban", "HIT", "HIT", "MISS")
+	p.Ban("other.com", "", "", "")
+	expect("after ban on another host", "HIT", "HIT", "HIT")
+	if err := p.Ban("", "(", "", ""); err == nil {
+		t.Error("invalid regexp should be refused")
+	}
+	if p.bans.len() != 3 {
+		t.Error("three bans should be kept, got", p.bans.len())
+	}
+}
+
+func Test_BanExpiry(t *testing.T) {
+	//Bans go once nothing they could apply to is left
+	bans := &banlist{}
+	bans.stored(time.Now().Add(-time.Second))
+	bans.add(&ban{})
+	if bans.len() != 0 {
+		t.Error("ban on objects that all expired should be dropped, got", bans.len())
+	}
+
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	})
+	p.get("/a")
+	p.Close()
+	//Memory stores cannot tell when their objects expire, the bans saved
+	//along with them can
+	restarted := &testproxy{ProxyServer: NewProxyServerWithStores([]Service{*p.configs["example.com"]}, p.objcache, p.metacache, t.TempDir())}
+	expected := time.Now().Add(time.Minute + staleretention)
+	if last := restarted.bans.lastexpiry; last.Before(expected.Add(-time.Second)) || last.After(expected.Add(expiryslack+time.Second)) {
+		t.Error("last expiry should be that of the stored object, got", last)
+	}
+	if w := restarted.get("/a"); cachestatus(w) != "HIT" {
+		t.Fatal("object should survive the restart, got", cachestatus(w))
+	}
+	restarted.Ban("", "^/a$", "", "")
+	if w := restarted.get("/a"); cachestatus(w) != "MISS" {
+		t.Error("ban should apply to objects stored before the restart, got", cachestatus(w))
+	}
+}
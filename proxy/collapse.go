@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//How long a collapsed request waits for the response headers of the fetch
+//it joined, before giving up and going to origin itself
+const collapsetimeout = 10 * time.Second
+
+//A flight is an origin fetch in progress for a cache miss. Concurrent misses
+//on the same objkey join it instead of fetching again. The body is recorded
+//to a spool file as it arrives, so each follower streams it at its own pace
+//without us holding it in memory.
+type flight struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	ready    chan struct{} //Closed once the outcome of the fetch is known
+	known    bool          //ready was closed
+	tookoff  bool          //A shareable response is being recorded
+	landed   bool          //Leader is done, nothing more will be recorded
+	eof      bool          //The whole body was recorded
+	meta     MetaItem
+	key      []byte //Key the response is stored under
+	spool    *os.File
+	recorded int64
+	refs     int //Leader and followers still using the spool
+}
+
+func newflight() *flight {
+	f := &flight{ready: make(chan struct{}), refs: 1}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+//Join the flight for objkey, or start one. leader is true if we started it
+//and have to fetch from origin.
+func (self *ProxyServer) joinflight(objkey []byte) (f *flight, leader bool) {
+	self.flightmutex.Lock()
+	defer self.flightmutex.Unlock()
+	f, ok := self.flights[string(objkey)]
+	if !ok {
+		f = newflight()
+		self.flights[string(objkey)] = f
+		return f, true
+	}
+	f.mu.Lock()
+	f.refs++
+	f.mu.Unlock()
+	return f, false
+}
+
+//Leader is done with the fetch, whatever happened. Followers still waiting
+//for headers fall back to their own fetch.
+func (self *ProxyServer) land(objkey []byte, f *flight) {
+	self.flightmutex.Lock()
+	delete(self.flights, string(objkey))
+	self.flightmutex.Unlock()
+	f.mu.Lock()
+	f.landed = true
+	f.decided()
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	f.release()
+}
+
+//Tell followers the outcome of the fetch is known. Must hold the lock.
+func (self *flight) decided() {
+	if !self.known {
+		self.known = true
+		close(self.ready)
+	}
+}
+
+//Leader got a response it will not store. Followers fall back to their own
+//fetch right away, rather than wait for the leader to finish with it.
+func (self *flight) ground() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.decided()
+}
+
+//Leader got a response it will store, share it with followers. Returns the
+//body to read in place of the origin body.
+func (self *flight) takeoff(meta MetaItem, key []byte, body io.ReadCloser, spooldir string) io.ReadCloser {
+	spool, err := ioutil.TempFile(spooldir, "goproxy-flight")
+	if err != nil {
+		return body
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.meta = meta
+	self.key = key
+	self.spool = spool
+	self.tookoff = true
+	self.decided()
+	return &flightrecorder{flight: self, body: body}
+}
+
+func (self *flight) release() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.refs--
+	if self.refs == 0 && self.spool != nil {
+		self.spool.Close()
+		os.Remove(self.spool.Name())
+	}
+}
+
+//Records what the leader reads from origin for the followers
+type flightrecorder struct {
+	flight *flight
+	body   io.ReadCloser
+}
+
+func (self *flightrecorder) Read(p []byte) (n int, err error) {
+	n, err = self.body.Read(p)
+	f := self.flight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n > 0 {
+		m, werr := f.spool.WriteAt(p[:n], f.recorded)
+		f.recorded += int64(m)
+		if werr != nil {
+			//Followers get a truncated body
+			f.landed = true
+		}
+	}
+	if err == io.EOF {
+		f.eof = true
+	}
+	f.cond.Broadcast()
+	return
+}
+
+func (self *flightrecorder) Close() error {
+	return self.body.Close()
+}
+
+//Streams the recorded body to a follower, waiting for more as needed
+type flightreader struct {
+	flight *flight
+	pos    int64
+}
+
+func (self *flightreader) Read(p []byte) (n int, err error) {
+	f := self.flight
+	f.mu.Lock()
+	for self.pos == f.recorded && !f.eof && !f.landed {
+		f.cond.Wait()
+	}
+	available := f.recorded - self.pos
+	eof := f.eof
+	f.mu.Unlock()
+	if available == 0 {
+		if eof {
+			return 0, io.EOF
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err = f.spool.ReadAt(p, self.pos)
+	self.pos += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func (self *flightreader) Close() error {
+	self.flight.release()
+	return nil
+}
+
+//Serve a follower from the flight it joined. Returns false if it has to
+//fetch from origin itself, because the leader took too long, got something
+//it would not store, or the response varies in a way that does not match us.
+func (self *ProxyServer) follow(req *transaction, service *Service, f *flight) bool {
+	waitstart := time.Now()
+	select {
+	case <-f.ready:
+	case <-time.After(collapsetimeout):
+		req.log("collapsed request timed out")
+		f.release()
+		return false
+	}
+	f.mu.Lock()
+	tookoff := f.tookoff
+	meta := f.meta
+	key := f.key
+	f.mu.Unlock()
+	if !tookoff {
+		f.release()
+		return false
+	}
+	if !bytes.Equal(service.varykey(req.metakey, req.clientreq.Header, storedvary(meta.Header)), key) {
+		f.release()
+		return false
+	}
+	req.collapsed = true
+	req.origintime = time.Since(waitstart)
+	req.servebody(meta, &flightreader{flight: f})
+	return true
+}
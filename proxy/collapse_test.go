@@ -0,0 +1,133 @@
+package goproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//A client that hangs up as soon as the body starts
+type brokenclient struct {
+	*httptest.ResponseRecorder
+}
+
+func (self *brokenclient) Write(p []byte) (int, error) {
+	return 0, errors.New("client went away")
+}
+
+//Origin sends the headers and the first half of the body, then waits for
+//release before sending the rest
+func sloworigin(release chan struct{}, cachecontrol string) http.HandlerFunc {
+	var requests int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cachecontrol)
+		w.Write([]byte("first half "))
+		w.(http.Flusher).Flush()
+		if atomic.AddInt32(&requests, 1) == 1 {
+			<-release
+		}
+		w.Write([]byte("second half"))
+	}
+}
+
+//Wait for n requests to be on the flights in progress
+func waitflights(t *testing.T, p *testproxy, n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		refs := 0
+		p.flightmutex.Lock()
+		for _, f := range p.flights {
+			f.mu.Lock()
+			refs += f.refs
+			f.mu.Unlock()
+		}
+		p.flightmutex.Unlock()
+		if refs == n {
+			return
+		}
+	}
+	t.Fatal("requests did not join the flight")
+}
+
+//Send a request in the background, done with wg once answered
+func sendasync(p *testproxy, w http.ResponseWriter, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r := httptest.NewRequest("GET", "/doc", nil)
+		r.Host = "example.com"
+		p.handler(w, r)
+	}()
+}
+
+func waitgroup(wg *sync.WaitGroup) (done chan struct{}) {
+	done = make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return
+}
+
+//Start the leader's request, with followers joining once it is on its way
+func collapse(t *testing.T, p *testproxy, leader http.ResponseWriter, followers int) (leaderdone, followersdone chan struct{}, responses []*httptest.ResponseRecorder) {
+	var lwg, fwg sync.WaitGroup
+	sendasync(p, leader, &lwg)
+	waitflights(t, p, 1)
+	for i := 0; i < followers; i++ {
+		w := httptest.NewRecorder()
+		responses = append(responses, w)
+		sendasync(p, w, &fwg)
+	}
+	return waitgroup(&lwg), waitgroup(&fwg), responses
+}
+
+func Test_Collapse(t *testing.T) {
+	for _, leadergone := range []bool{false, true} {
+		release := make(chan struct{})
+		p := newtestproxy(t, sloworigin(release, "max-age=60"))
+		var leader http.ResponseWriter = httptest.NewRecorder()
+		if leadergone {
+			leader = &brokenclient{httptest.NewRecorder()}
+		}
+		leaderdone, followersdone, followers := collapse(t, p, leader, 3)
+		waitflights(t, p, 4)
+		close(release)
+		<-leaderdone
+		<-followersdone
+		for _, w := range followers {
+			if cachestatus(w) != "COLLAPSED" || readbody(w) != "first half second half" {
+				t.Error(leadergone, "follower should get the whole body of the leader's fetch, got", cachestatus(w), readbody(w))
+			}
+		}
+		if n := p.fetched(); n != 1 {
+			t.Error(leadergone, "origin should be fetched once, got", n)
+		}
+		if w := p.get("/doc"); cachestatus(w) != "HIT" || readbody(w) != "first half second half" {
+			t.Error(leadergone, "fetch should be stored, got", cachestatus(w), readbody(w))
+		}
+	}
+}
+
+func Test_CollapseUncacheable(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	p := newtestproxy(t, sloworigin(release, "no-store"))
+	leader := httptest.NewRecorder()
+	leaderdone, followersdone, followers := collapse(t, p, leader, 3)
+	select {
+	case <-followersdone:
+	case <-leaderdone:
+		t.Fatal("leader should still be waiting on origin")
+	case <-time.After(5 * time.Second):
+		t.Fatal("followers should not wait for the leader's body")
+	}
+	for _, w := range followers {
+		if cachestatus(w) != "MISS" || readbody(w) != "first half second half" {
+			t.Error("follower should fetch on its own, got", cachestatus(w), readbody(w))
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package goproxy
+
+import (
+	"compress/gzip"
+	"github.com/sajal/gohttpcache/cache"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Added to responses whose payload we transformed, rfc7234 section 5.5.6
+const transformwarning = `214 - "Transformation Applied"`
+
+//Codings listed in Accept-Encoding, with whether they are acceptable (q > 0)
+func acceptedcodings(value string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, coding := range strings.Split(value, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		accepted[name] = q > 0
+	}
+	return accepted
+}
+
+//NormalizeAcceptEncoding buckets Accept-Encoding into the coding we would
+//pick for the client: br, gzip or identity.
+func NormalizeAcceptEncoding(value string) string {
+	accepted := acceptedcodings(value)
+	switch {
+	case accepted["br"]:
+		return "br"
+	case accepted["gzip"] || accepted["x-gzip"]:
+		return "gzip"
+	}
+	return "identity"
+}
+
+func acceptsgzip(reqhdrs http.Header) bool {
+	accepted := acceptedcodings(strings.Join(reqhdrs[http.CanonicalHeaderKey("Accept-Encoding")], ","))
+	return accepted["gzip"] || accepted["x-gzip"]
+}
+
+//The Accept-Encoding we send to origin. Anything we store can be turned into
+//gzip or identity for any client, so those are all we ask for.
+func originencoding(reqhdrs http.Header) string {
+	if acceptsgzip(reqhdrs) {
+		return "gzip"
+	}
+	return "identity"
+}
+
+//Can we change the coding of a response? Not if origin forbids it with
+//no-transform, rfc7234 section 5.2.2.4, or it uses a coding we do not know.
+func transformable(reshdrs http.Header) bool {
+	if gohttpcache.ParseCacheControl(reshdrs[http.CanonicalHeaderKey("Cache-Control")]).Has("no-transform") {
+		return false
+	}
+	switch strings.ToLower(reshdrs.Get("Content-Encoding")) {
+	case "", "identity", "gzip", "x-gzip":
+		return true
+	}
+	return false
+}
+
+//Worth compressing? Text and the usual text based formats.
+func compressible(contenttype string) bool {
+	mediatype, _, err := mime.ParseMediaType(contenttype)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediatype, "text/"),
+		strings.HasSuffix(mediatype, "+xml"),
+		strings.HasSuffix(mediatype, "+json"):
+		return true
+	}
+	switch mediatype {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+//Gzips a body as it is read. Close stops compressing and waits for it.
+type compressor struct {
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+func newcompressor(body io.Reader) *compressor {
+	pr, pw := io.Pipe()
+	c := &compressor{pr: pr, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return c
+}
+
+func (self *compressor) Read(p []byte) (int, error) {
+	return self.pr.Read(p)
+}
+
+func (self *compressor) Close() error {
+	self.pr.Close()
+	<-self.done
+	return nil
+}
+
+//Headers for a payload we recoded. The validator is weakened since the
+//bytes are no longer what origin sent, rfc7232 section 2.1.
+func transformedmeta(meta MetaItem, encoding string) MetaItem {
+	meta.Header = meta.Header.Clone()
+	meta.Header.Del("Content-Length")
+	if encoding == "" {
+		meta.Header.Del("Content-Encoding")
+	} else {
+		meta.Header.Set("Content-Encoding", encoding)
+	}
+	if etag := meta.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		meta.Header.Set("ETag", "W/"+etag)
+	}
+	varies := false
+	for _, field := range parsevary(meta.Header) {
+		varies = varies || field == "Accept-Encoding"
+	}
+	if !varies {
+		meta.Header.Add("Vary", "Accept-Encoding")
+	}
+	meta.Header.Add("Warning", transformwarning)
+	return meta
+}
+
+//Recode a stored 200 for what the client accepts, rfc7231 section 5.3.4.
+//Gzip is decompressed for clients that do not take it, and compressible
+//identity payloads are compressed for those that do, unless the client asked
+//for a range or no-transform. Returns a nil body if nothing needs doing.
+func (self *transaction) transform(meta MetaItem, item io.Reader) (transformed MetaItem, body io.ReadCloser) {
+	if meta.Status != http.StatusOK || !transformable(meta.Header) {
+		return meta, nil
+	}
+	gzipok := acceptsgzip(self.clientreq.Header)
+	switch strings.ToLower(meta.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		if gzipok {
+			return meta, nil
+		}
+		zr, err := gzip.NewReader(item)
+		if err != nil {
+			self.log("transform", err)
+			return meta, nil
+		}
+		return transformedmeta(meta, ""), zr
+	default:
+		if !gzipok || self.clientreq.Header.Get("Range") != "" || !compressible(meta.Header.Get("Content-Type")) {
+			return meta, nil
+		}
+		if gohttpcache.ParseCacheControl(self.clientreq.Header[http.CanonicalHeaderKey("Cache-Control")]).Has("no-transform") {
+			return meta, nil
+		}
+		return transformedmeta(meta, "gzip"), newcompressor(item)
+	}
+}
@@ -0,0 +1,129 @@
+package goproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_NormalizeAcceptEncoding(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                     "identity",
+		"gzip":                 "gzip",
+		"x-gzip":               "gzip",
+		"GZIP;q=0.5, deflate":  "gzip",
+		"br, gzip":             "br",
+		"br;q=0, gzip":         "gzip",
+		"gzip;q=0":             "identity",
+		"deflate, identity":    "identity",
+		" gzip ; q=1 , br;q=0": "gzip",
+	} {
+		if got := NormalizeAcceptEncoding(value); got != expected {
+			t.Error(value, "should normalize to", expected, "got", got)
+		}
+	}
+}
+
+func Test_Compressible(t *testing.T) {
+	for contenttype, expected := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"application/json":         true,
+		"application/ld+json":      true,
+		"application/atom+xml":     true,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"application/octet-stream": false,
+		"":                         false,
+	} {
+		if compressible(contenttype) != expected {
+			t.Error(contenttype, "compressible should be", expected)
+		}
+	}
+}
+
+func gunzipbody(t *testing.T, w *httptest.ResponseRecorder) string {
+	zr, err := gzip.NewReader(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+//Check the headers of a response we recoded
+func checktransformed(t *testing.T, name string, w *httptest.ResponseRecorder, coding string) {
+	if w.Header().Get("Content-Encoding") != coding || w.Header().Get("Content-Length") != "" {
+		t.Error(name, "should be recoded to", coding, "got", w.Header())
+	}
+	if w.Header().Get("ETag") != `W/"v1"` {
+		t.Error(name, "recoded response should have a weak ETag, got", w.Header().Get("ETag"))
+	}
+	if vary := w.Header()["Vary"]; len(vary) != 1 || !strings.Contains(vary[0], "Accept-Encoding") {
+		t.Error(name, "recoded response should vary on Accept-Encoding once, got", vary)
+	}
+	if w.Header().Get("Warning") != transformwarning {
+		t.Error(name, "recoded response should carry a 214 warning, got", w.Header().Get("Warning"))
+	}
+}
+
+func Test_Transform(t *testing.T) {
+	content := strings.Repeat("some text ", 100)
+	var cachecontrol string
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cachecontrol)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/vary" {
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+		if r.Header.Get("Accept-Encoding") == "gzip" && r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped([]byte(content)))
+			return
+		}
+		w.Write([]byte(content))
+	})
+	cachecontrol = "max-age=60"
+	//Stored as identity, compressed for clients that take gzip
+	p.get("/plain")
+	w := p.get("/plain", "Accept-Encoding", "gzip")
+	checktransformed(t, "compressed", w, "gzip")
+	if gunzipbody(t, w) != content {
+		t.Error("compressed body should gunzip to the original")
+	}
+	w = p.get("/vary", "Accept-Encoding", "gzip")
+	checktransformed(t, "compressed with Vary", w, "gzip")
+	//Stored gzipped, decompressed for clients that do not take gzip
+	p.get("/gzip", "Accept-Encoding", "gzip")
+	w = p.get("/gzip", "Accept-Encoding", "identity")
+	checktransformed(t, "decompressed", w, "")
+	if readbody(w) != content {
+		t.Error("decompressed body should be the original")
+	}
+	if w = p.get("/gzip", "Accept-Encoding", "gzip"); w.Header().Get("ETag") != `"v1"` || gunzipbody(t, w) != content {
+		t.Error("gzip client should get the stored object as is, got", w.Header())
+	}
+	//Clients asking for ranges or no-transform get what is stored
+	for _, hdr := range [][]string{{"Range", "bytes=0-9"}, {"Cache-Control", "no-transform"}} {
+		w = p.get("/plain", "Accept-Encoding", "gzip", hdr[0], hdr[1])
+		if w.Header().Get("Content-Encoding") != "" || w.Header().Get("ETag") != `"v1"` {
+			t.Error(hdr, "should not be recoded, got", w.Header())
+		}
+	}
+
+	cachecontrol = "max-age=60, no-transform"
+	for _, c := range [][]string{{"/notransform", "gzip"}, {"/gzip", "identity"}} {
+		p.PurgeURL("example.com", c[0], false)
+		p.get(c[0], "Accept-Encoding", "gzip")
+		w = p.get(c[0], "Accept-Encoding", c[1])
+		if w.Header().Get("Warning") != "" || w.Header().Get("ETag") != `"v1"` {
+			t.Error(c[0], "origin's no-transform should be respected, got", w.Header())
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+//Objects are stored in objcache as
+//
+//	magic     "GPC" followed by the format version
+//	metasize  uint32
+//	metacrc   uint32, crc32 of the metadata
+//	bodysize  uint64
+//	metadata  MetaItem, see encodemeta
+//	body
+//	bodycrc   uint32, crc32 of the body
+//
+//integers little endian. Entries in any other format, including those
+//stored before the format was versioned, are treated as misses.
+var entrymagic = []byte("GPC\x02")
+
+const (
+	entryheadersize  = 4 + 4 + 4 + 8
+	entrytrailersize = 4
+	maxmetasize      = 1 << 20 //Sanity limit, metadata is mostly headers
+)
+
+var (
+	errentryformat  = errors.New("not a cached entry in the current format")
+	errentrycorrupt = errors.New("cached entry failed its checksum")
+	errmetasize     = errors.New("metadata too large to store")
+)
+
+//Bytes taken by an entry with this metadata and body size
+func entrysize(metabyt []byte, bodysize int64) int {
+	return entryheadersize + len(metabyt) + int(bodysize) + entrytrailersize
+}
+
+//Write an entry up to where the body starts
+func writeentryheader(w io.Writer, metabyt []byte, bodysize int64) (err error) {
+	if len(metabyt) > maxmetasize {
+		return errmetasize
+	}
+	header := make([]byte, entryheadersize)
+	copy(header, entrymagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(metabyt)))
+	binary.LittleEndian.PutUint32(header[8:], crc32.ChecksumIEEE(metabyt))
+	binary.LittleEndian.PutUint64(header[12:], uint64(bodysize))
+	_, err = w.Write(header)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(metabyt)
+	return
+}
+
+//Finish an entry after the body
+func writeentrytrailer(w io.Writer, bodycrc uint32) (err error) {
+	var trailer [entrytrailersize]byte
+	binary.LittleEndian.PutUint32(trailer[:], bodycrc)
+	_, err = w.Write(trailer[:])
+	return
+}
+
+//Read the metadata of a stored object, returning its body to read after.
+//Objects that are not in the current format or fail their metadata
+//checksum are deleted, so they are fetched again.
+func (self *ProxyServer) loadentry(key []byte, item StoreItem) (meta MetaItem, body *entrybody, err error) {
+	meta, body, err = readentry(item)
+	if err != nil {
+		self.objcache.Delete(key)
+		return
+	}
+	body.store = self.objcache
+	body.key = key
+	return
+}
+
+func readentry(item StoreItem) (meta MetaItem, body *entrybody, err error) {
+	header := make([]byte, entryheadersize)
+	_, err = io.ReadFull(item, header)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errentryformat
+		}
+		return
+	}
+	if !bytes.Equal(header[:4], entrymagic) {
+		err = errentryformat
+		return
+	}
+	metasize := binary.LittleEndian.Uint32(header[4:])
+	if metasize > maxmetasize {
+		err = errentrycorrupt
+		return
+	}
+	metabyt := make([]byte, metasize)
+	_, err = io.ReadFull(item, metabyt)
+	if err != nil {
+		err = errentrycorrupt
+		return
+	}
+	if crc32.ChecksumIEEE(metabyt) != binary.LittleEndian.Uint32(header[8:]) {
+		err = errentrycorrupt
+		return
+	}
+	meta, err = decodemeta(metabyt)
+	if err != nil {
+		return
+	}
+	body = &entrybody{
+		item:  item,
+		start: int64(entryheadersize) + int64(metasize),
+		size:  int64(binary.LittleEndian.Uint64(header[12:])),
+		crc:   crc32.NewIEEE(),
+	}
+	return
+}
+
+//The body of a stored object. Read in order from the start, it is checked
+//against its checksum at the end, and a corrupt object is deleted. The
+//client has been sent it by then, but the next one will not be.
+type entrybody struct {
+	item  StoreItem
+	store Store
+	key   []byte
+	start int64 //Offset of the body in the entry
+	size  int64
+	pos   int64
+	crc   hash.Hash32 //nil once the body is not read in order
+}
+
+func (self *entrybody) Read(p []byte) (n int, err error) {
+	if self.pos >= self.size {
+		return 0, self.verify()
+	}
+	if int64(len(p)) > self.size-self.pos {
+		p = p[:self.size-self.pos]
+	}
+	n, err = self.item.Read(p)
+	self.pos += int64(n)
+	if self.crc != nil {
+		self.crc.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+//Compare the checksum once at the end of the body
+func (self *entrybody) verify() error {
+	if self.crc == nil {
+		return io.EOF
+	}
+	sum := self.crc.Sum32()
+	self.crc = nil
+	var trailer [entrytrailersize]byte
+	_, err := io.ReadFull(self.item, trailer[:])
+	if err != nil || binary.LittleEndian.Uint32(trailer[:]) != sum {
+		if self.store != nil {
+			self.store.Delete(self.key)
+		}
+		return errentrycorrupt
+	}
+	return io.EOF
+}
+
+func (self *entrybody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.pos
+	case io.SeekEnd:
+		offset += self.size
+	default:
+		return self.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return self.pos, errors.New("negative position")
+	}
+	if offset > self.size {
+		offset = self.size
+	}
+	if offset == self.pos {
+		return self.pos, nil
+	}
+	_, err := self.item.Seek(self.start+offset, io.SeekStart)
+	if err != nil {
+		return self.pos, err
+	}
+	self.pos = offset
+	if offset == 0 {
+		self.crc = crc32.NewIEEE()
+	} else {
+		self.crc = nil
+	}
+	return self.pos, nil
+}
+
+func (self *entrybody) Close() error {
+	return self.item.Close()
+}
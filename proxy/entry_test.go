@@ -0,0 +1,101 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testentry(t *testing.T, meta MetaItem, body string) []byte {
+	fill, err := newcachefill(NewMemoryStore(1<<20), []byte("k"), time.Hour, encodemeta(meta), int64(len(body)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill.Write([]byte(body))
+	if err := fill.commit(); err != nil {
+		t.Fatal(err)
+	}
+	value, err := getvalue(fill.cache, []byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func loadtestentry(entry []byte) (store Store, meta MetaItem, body string, err error) {
+	store = NewMemoryStore(1 << 20)
+	setvalue(store, []byte("k"), entry, time.Hour)
+	proxy := &ProxyServer{objcache: store}
+	item, _ := store.Get([]byte("k"))
+	meta, b, err := proxy.loadentry([]byte("k"), item)
+	if err != nil {
+		return
+	}
+	defer b.Close()
+	read, err := ioutil.ReadAll(b)
+	return store, meta, string(read), err
+}
+
+func Test_Entry(t *testing.T) {
+	//Headers bigger than an int16 length can describe
+	hdr := http.Header{"X-Big": []string{strings.Repeat("x", 40000)}}
+	entry := testentry(t, MetaItem{Header: hdr, Status: 200}, "hello world")
+	_, meta, body, err := loadtestentry(entry)
+	if err != nil || meta.Status != 200 || len(meta.Header.Get("X-Big")) != 40000 || body != "hello world" {
+		t.Error("entry should round trip, got", meta.Status, body, err)
+	}
+
+	//Seeking skips the checksum but stays within the body
+	store := NewMemoryStore(1 << 20)
+	setvalue(store, []byte("k"), entry, time.Hour)
+	item, _ := store.Get([]byte("k"))
+	_, b, _ := (&ProxyServer{objcache: store}).loadentry([]byte("k"), item)
+	b.Seek(-5, io.SeekEnd)
+	tail, err := ioutil.ReadAll(b)
+	if string(tail) != "world" || err != nil {
+		t.Error("read after seek should be world, got", string(tail), err)
+	}
+}
+
+func Test_EntryCorrupt(t *testing.T) {
+	entry := testentry(t, MetaItem{Status: 200}, "hello world")
+
+	//As stored before the format was versioned, an int16 length and gob
+	var metabuf bytes.Buffer
+	gob.NewEncoder(&metabuf).Encode(&MetaItem{Status: 200})
+	old := append([]byte{byte(metabuf.Len()), 0}, metabuf.Bytes()...)
+	if store, _, _, err := loadtestentry(old); err != errentryformat {
+		t.Error("old format should be errentryformat, got", err)
+	} else if _, err := store.Get([]byte("k")); err != ErrNotFound {
+		t.Error("old format entry should be deleted, got", err)
+	}
+
+	damaged := append([]byte(nil), entry...)
+	damaged[entryheadersize+1] ^= 0xff
+	if _, _, _, err := loadtestentry(damaged); err != errentrycorrupt {
+		t.Error("damaged metadata should be errentrycorrupt, got", err)
+	}
+
+	damaged = append([]byte(nil), entry...)
+	damaged[len(damaged)-entrytrailersize-1] ^= 0xff
+	if store, _, _, err := loadtestentry(damaged); err != errentrycorrupt {
+		t.Error("damaged body should be errentrycorrupt, got", err)
+	} else if _, err := store.Get([]byte("k")); err != ErrNotFound {
+		t.Error("damaged entry should be deleted, got", err)
+	}
+
+	if _, _, _, err := loadtestentry(entry[:len(entry)-8]); err != io.ErrUnexpectedEOF {
+		t.Error("truncated body should be io.ErrUnexpectedEOF, got", err)
+	}
+
+	binary.LittleEndian.PutUint32(entry[4:], maxmetasize+1)
+	if _, _, _, err := loadtestentry(entry); err != errentrycorrupt {
+		t.Error("oversized metadata length should be errentrycorrupt, got", err)
+	}
+}
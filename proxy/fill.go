@@ -0,0 +1,205 @@
+package goproxy
+
+import (
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var errfillsize = errors.New("body size does not match Content-Length")
+
+//cachefill writes an object into cache as it streams in from origin. With
+//a known size the store transaction is opened up front and written directly,
+//otherwise the body is spooled to a temp file and copied in on commit.
+//Either way nothing bigger than a read buffer is held in memory.
+type cachefill struct {
+	key     []byte
+	ttl     time.Duration
+	hdrbyt  []byte
+	cache   Store
+	txn     StoreTxn
+	spool   *os.File
+	size    int64 //Expected body size, -1 if unknown
+	written int64
+	crc     hash.Hash32 //Of the body written so far
+	err     error
+}
+
+func newcachefill(cache Store, key []byte, ttl time.Duration, hdrbyt []byte, size int64, spooldir string) (fill *cachefill, err error) {
+	fill = &cachefill{key: key, ttl: ttl, hdrbyt: hdrbyt, cache: cache, size: size, crc: crc32.NewIEEE()}
+	if len(hdrbyt) > maxmetasize {
+		return nil, errmetasize
+	}
+	if size >= 0 {
+		fill.txn, err = cache.Set(key, entrysize(hdrbyt, size), ttl)
+		if err != nil {
+			return
+		}
+		err = writeentryheader(fill.txn, hdrbyt, size)
+		if err != nil {
+			fill.txn.Rollback()
+		}
+		return
+	}
+	fill.spool, err = ioutil.TempFile(spooldir, "goproxy-spool")
+	return
+}
+
+func (self *cachefill) Write(p []byte) (n int, err error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	if self.txn != nil {
+		if self.written+int64(len(p)) > self.size {
+			self.err = errfillsize
+			return 0, self.err
+		}
+		n, err = self.txn.Write(p)
+	} else {
+		n, err = self.spool.Write(p)
+	}
+	self.written += int64(n)
+	self.crc.Write(p[:n])
+	if err != nil {
+		self.err = err
+	}
+	return
+}
+
+//Store the object, once the whole body was written
+func (self *cachefill) commit() (err error) {
+	if self.err != nil {
+		self.abort()
+		return self.err
+	}
+	if self.txn != nil {
+		if self.written != self.size {
+			self.txn.Rollback()
+			return errfillsize
+		}
+		err = writeentrytrailer(self.txn, self.crc.Sum32())
+		if err != nil {
+			self.txn.Rollback()
+			return
+		}
+		return self.txn.Commit()
+	}
+	defer self.removespool()
+	_, err = self.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	txn, err := self.cache.Set(self.key, entrysize(self.hdrbyt, self.written), self.ttl)
+	if err != nil {
+		return
+	}
+	err = writeentryheader(txn, self.hdrbyt, self.written)
+	if err == nil {
+		_, err = io.CopyN(txn, self.spool, self.written)
+	}
+	if err == nil {
+		err = writeentrytrailer(txn, self.crc.Sum32())
+	}
+	if err != nil {
+		txn.Rollback()
+		return
+	}
+	return txn.Commit()
+}
+
+//Throw away whatever was written so far
+func (self *cachefill) abort() {
+	if self.txn != nil {
+		self.txn.Rollback()
+	} else {
+		self.removespool()
+	}
+}
+
+func (self *cachefill) removespool() {
+	self.spool.Close()
+	os.Remove(self.spool.Name())
+}
+
+//Feeds everything read from an origin body into a cachefill, remembering
+//if origin failed us midway.
+type fillreader struct {
+	body io.ReadCloser
+	fill *cachefill
+	err  error
+}
+
+func (self *fillreader) Read(p []byte) (n int, err error) {
+	n, err = self.body.Read(p)
+	if n > 0 {
+		self.fill.Write(p[:n])
+	}
+	if err != nil && err != io.EOF {
+		self.err = err
+	}
+	return
+}
+
+//Closing is left to whoever owns the origin response
+func (self *fillreader) Close() error {
+	return nil
+}
+
+//Remembers if writing to the client failed, so we stop reading from origin
+type clientwriter struct {
+	http.ResponseWriter
+	err error
+}
+
+func (self *clientwriter) Write(p []byte) (n int, err error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	n, err = self.ResponseWriter.Write(p)
+	if err != nil {
+		self.err = err
+	}
+	return
+}
+
+//Pass flushes thru, so a slow origin body reaches the client as it arrives
+func (self *clientwriter) Flush() {
+	if f, ok := self.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Serve an origin response to the client while filling it into cache. The
+//body is read only once. Whatever the client did not need (ranges, 304s) is
+//still read to complete the object, and so is the rest of it if the client
+//goes away, as collapsed requests may be waiting on it. An origin error
+//aborts the fill.
+func (self *ProxyServer) servefill(req *transaction, meta MetaItem, body io.ReadCloser, fill *cachefill) {
+	fr := &fillreader{body: body, fill: fill}
+	cw := &clientwriter{ResponseWriter: req.respwriter}
+	req.respwriter = cw
+	req.servebody(meta, fr)
+	req.respwriter = cw.ResponseWriter
+	if cw.err != nil {
+		req.log("client went away, still storing:", cw.err)
+	}
+	if fr.err == nil {
+		io.Copy(ioutil.Discard, fr)
+	}
+	switch {
+	case fr.err != nil:
+		req.log("origin failed, not storing:", fr.err)
+		fill.abort()
+	default:
+		err := fill.commit()
+		if err != nil {
+			log.Println(string(fill.key), err)
+		}
+	}
+}
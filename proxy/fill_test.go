@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_CacheFill(t *testing.T) {
+	meta := MetaItem{Header: http.Header{"X-Test": []string{"fill"}}, Status: 200}
+	//Known size goes straight to the store, unknown is spooled first
+	for _, size := range []int64{11, -1} {
+		store := NewMemoryStore(1 << 20)
+		spooldir := t.TempDir()
+		fill, err := newcachefill(store, []byte("k"), time.Hour, encodemeta(meta), size, spooldir)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		fill.Write([]byte("hello "))
+		if _, err := store.Get([]byte("k")); err != ErrNotFound {
+			t.Error(size, "object should not be visible before commit, got", err)
+		}
+		fill.Write([]byte("world"))
+		if err := fill.commit(); err != nil {
+			t.Fatal(size, err)
+		}
+		entry, _ := getvalue(store, []byte("k"))
+		_, got, body, err := loadtestentry(entry)
+		if err != nil || got.Header.Get("X-Test") != "fill" || body != "hello world" {
+			t.Error(size, "filled object should load back, got", got, body, err)
+		}
+		if spooled, _ := os.ReadDir(spooldir); len(spooled) != 0 {
+			t.Error(size, "spool should be removed, found", spooled)
+		}
+	}
+
+	//Partial bodies are not stored
+	for _, size := range []int64{11, -1} {
+		store := NewMemoryStore(1 << 20)
+		fill, _ := newcachefill(store, []byte("k"), time.Hour, encodemeta(meta), size, t.TempDir())
+		fill.Write([]byte("hello "))
+		if size < 0 {
+			fill.abort()
+		} else if err := fill.commit(); err == nil {
+			t.Error(size, "commit of a short body should fail")
+		}
+		if _, err := store.Get([]byte("k")); err != ErrNotFound {
+			t.Error(size, "partial object should not be stored, got", err)
+		}
+	}
+}
+
+func Test_ServeFillPartial(t *testing.T) {
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/sized" {
+			w.Header().Set("Content-Length", strconv.Itoa(100))
+		}
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		//Origin dies midway
+		panic(http.ErrAbortHandler)
+	})
+	for _, path := range []string{"/sized", "/chunked"} {
+		if w := p.get(path); readbody(w) != "partial" {
+			t.Error(path, "client should get what origin sent, got", readbody(w))
+		}
+		if w := p.get(path); cachestatus(w) != "MISS" {
+			t.Error(path, "partial response should not be stored, got", cachestatus(w))
+		}
+	}
+}
+
+func Test_ClientWriterFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	var cw http.ResponseWriter = &clientwriter{ResponseWriter: w}
+	f, ok := cw.(http.Flusher)
+	if !ok {
+		t.Fatal("clientwriter should be a Flusher")
+	}
+	f.Flush()
+	if !w.Flushed {
+		t.Error("flush should reach the client")
+	}
+}
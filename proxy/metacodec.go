@@ -0,0 +1,291 @@
+package goproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//Metadata is encoded by hand rather than with gob, so it stays small and
+//tools in other languages can read it. Every value starts with its own
+//format version byte, then fields in order using
+//
+//	uint     unsigned varint, as in protobuf
+//	int      signed zigzag varint, as in protobuf sint64
+//	bytes    uint length, then that many bytes. Strings are UTF-8 bytes.
+//	time     int unix nanoseconds, 0 for none
+//	duration int nanoseconds
+//	header   uint number of fields sorted by name, each the name as bytes,
+//	         uint number of values, and each value as bytes
+//
+//MetaItem (version 1):
+//
+//	status uint, fetched time, requested time, lifetime duration,
+//	stale-while-revalidate duration, stale-if-error duration,
+//	flags uint (1 must-revalidate), objkey bytes, header header
+//
+//variants (version 1):
+//
+//	uint number of Vary lists, each a uint number of field names as bytes,
+//	then uint number of objkeys, each as bytes
+//
+//sliceditem (version 2):
+//
+//	meta bytes (an encoded MetaItem), size int, version bytes, slice size int
+const (
+	metaversion     = 1
+	variantsversion = 1
+	slicedversion   = 2
+)
+
+const flagmustrevalidate = 1
+
+var errmetaformat = errors.New("metadata is not in a known format")
+
+type metawriter struct {
+	buf []byte
+}
+
+func (self *metawriter) uint(v uint64) {
+	self.buf = binary.AppendUvarint(self.buf, v)
+}
+
+func (self *metawriter) int(v int64) {
+	self.buf = binary.AppendVarint(self.buf, v)
+}
+
+func (self *metawriter) bytes(b []byte) {
+	self.uint(uint64(len(b)))
+	self.buf = append(self.buf, b...)
+}
+
+func (self *metawriter) string(s string) {
+	self.uint(uint64(len(s)))
+	self.buf = append(self.buf, s...)
+}
+
+func (self *metawriter) time(t time.Time) {
+	if t.IsZero() {
+		self.int(0)
+		return
+	}
+	self.int(t.UnixNano())
+}
+
+func (self *metawriter) header(hdr http.Header) {
+	names := make([]string, 0, len(hdr))
+	for k := range hdr {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	self.uint(uint64(len(names)))
+	for _, k := range names {
+		self.string(k)
+		self.uint(uint64(len(hdr[k])))
+		for _, v := range hdr[k] {
+			self.string(v)
+		}
+	}
+}
+
+//Reads what metawriter wrote. The first error sticks and everything read
+//after it is zero, so decoders check once at the end.
+type metareader struct {
+	buf []byte
+	err error
+}
+
+func (self *metareader) uint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(self.buf)
+	if n <= 0 {
+		self.err = errmetaformat
+		return 0
+	}
+	self.buf = self.buf[n:]
+	return v
+}
+
+func (self *metareader) int() int64 {
+	if self.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(self.buf)
+	if n <= 0 {
+		self.err = errmetaformat
+		return 0
+	}
+	self.buf = self.buf[n:]
+	return v
+}
+
+func (self *metareader) bytes() []byte {
+	n := self.uint()
+	if self.err != nil {
+		return nil
+	}
+	if n > uint64(len(self.buf)) {
+		self.err = errmetaformat
+		return nil
+	}
+	b := self.buf[:n:n]
+	self.buf = self.buf[n:]
+	return b
+}
+
+func (self *metareader) string() string {
+	return string(self.bytes())
+}
+
+func (self *metareader) time() time.Time {
+	ns := self.int()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (self *metareader) duration() time.Duration {
+	return time.Duration(self.int())
+}
+
+//A count of things each taking at least a byte, so corrupt input cannot
+//make us allocate more than it could hold
+func (self *metareader) count() int {
+	n := self.uint()
+	if n > uint64(len(self.buf)) {
+		self.err = errmetaformat
+		return 0
+	}
+	return int(n)
+}
+
+func (self *metareader) version(want byte) {
+	if len(self.buf) == 0 || self.buf[0] != want {
+		self.err = errmetaformat
+		return
+	}
+	self.buf = self.buf[1:]
+}
+
+//Anything left over means we misread it
+func (self *metareader) end() error {
+	if self.err == nil && len(self.buf) != 0 {
+		self.err = errmetaformat
+	}
+	return self.err
+}
+
+func (self *metareader) header() http.Header {
+	n := self.count()
+	if n == 0 {
+		return nil
+	}
+	hdr := make(http.Header, n)
+	for i := 0; i < n && self.err == nil; i++ {
+		k := self.string()
+		values := make([]string, self.count())
+		for j := range values {
+			values[j] = self.string()
+		}
+		hdr[k] = values
+	}
+	return hdr
+}
+
+func encodemeta(meta MetaItem) []byte {
+	w := &metawriter{buf: []byte{metaversion}}
+	w.uint(uint64(meta.Status))
+	w.time(meta.Fetched)
+	w.time(meta.Requested)
+	w.int(int64(meta.Lifetime))
+	w.int(int64(meta.StaleWhileRevalidate))
+	w.int(int64(meta.StaleIfError))
+	var flags uint64
+	if meta.MustRevalidate {
+		flags |= flagmustrevalidate
+	}
+	w.uint(flags)
+	w.bytes(meta.ObjKey)
+	w.header(meta.Header)
+	return w.buf
+}
+
+func decodemeta(b []byte) (meta MetaItem, err error) {
+	r := &metareader{buf: b}
+	r.version(metaversion)
+	meta.Status = int(r.uint())
+	meta.Fetched = r.time()
+	meta.Requested = r.time()
+	meta.Lifetime = r.duration()
+	meta.StaleWhileRevalidate = r.duration()
+	meta.StaleIfError = r.duration()
+	meta.MustRevalidate = r.uint()&flagmustrevalidate != 0
+	if objkey := r.bytes(); len(objkey) > 0 {
+		meta.ObjKey = append([]byte(nil), objkey...)
+	}
+	meta.Header = r.header()
+	err = r.end()
+	return
+}
+
+func encodevariants(v variants) []byte {
+	w := &metawriter{buf: []byte{variantsversion}}
+	w.uint(uint64(len(v.Varies)))
+	for _, vary := range v.Varies {
+		w.uint(uint64(len(vary)))
+		for _, field := range vary {
+			w.string(field)
+		}
+	}
+	w.uint(uint64(len(v.Keys)))
+	for _, key := range v.Keys {
+		w.bytes(key)
+	}
+	return w.buf
+}
+
+func decodevariants(b []byte) (v variants, err error) {
+	r := &metareader{buf: b}
+	r.version(variantsversion)
+	v.Varies = make([][]string, r.count())
+	for i := range v.Varies {
+		v.Varies[i] = make([]string, r.count())
+		for j := range v.Varies[i] {
+			v.Varies[i][j] = r.string()
+		}
+	}
+	v.Keys = make([][]byte, r.count())
+	for i := range v.Keys {
+		v.Keys[i] = append([]byte(nil), r.bytes()...)
+	}
+	err = r.end()
+	return
+}
+
+func encodesliced(sliced sliceditem) []byte {
+	w := &metawriter{buf: []byte{slicedversion}}
+	w.bytes(encodemeta(sliced.Meta))
+	w.int(sliced.Size)
+	w.string(sliced.Version)
+	w.int(sliced.SliceSize)
+	return w.buf
+}
+
+func decodesliced(b []byte) (sliced sliceditem, err error) {
+	r := &metareader{buf: b}
+	r.version(slicedversion)
+	meta := r.bytes()
+	sliced.Size = r.int()
+	sliced.Version = r.string()
+	sliced.SliceSize = r.int()
+	if err = r.end(); err != nil {
+		return
+	}
+	sliced.Meta, err = decodemeta(meta)
+	return
+}
@@ -0,0 +1,101 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testmeta() MetaItem {
+	fetched := time.Unix(0, time.Date(2020, 3, 1, 12, 0, 0, 123, time.UTC).UnixNano())
+	return MetaItem{
+		Header: http.Header{
+			"Cache-Control":  {"public, max-age=3600, stale-while-revalidate=60"},
+			"Content-Type":   {"text/html; charset=utf-8"},
+			"Content-Length": {"5120"},
+			"Etag":           {`"5e5b9a4c-1400"`},
+			"Last-Modified":  {"Sun, 01 Mar 2020 11:00:00 GMT"},
+			"Vary":           {"Accept-Encoding"},
+			"Server":         {"nginx"},
+			"Warning":        {`110 - "Response is Stale"`, `214 - "Transformation Applied"`},
+		},
+		ObjKey:               []byte("GETt/index.html"),
+		Fetched:              fetched,
+		Status:               200,
+		Requested:            fetched.Add(-20 * time.Millisecond),
+		Lifetime:             time.Hour,
+		MustRevalidate:       true,
+		StaleWhileRevalidate: time.Minute,
+	}
+}
+
+func Test_MetaCodec(t *testing.T) {
+	meta := testmeta()
+	got, err := decodemeta(encodemeta(meta))
+	if err != nil || !reflect.DeepEqual(got, meta) {
+		t.Error("MetaItem should round trip, got", got, err)
+	}
+	if got, err := decodemeta(encodemeta(MetaItem{})); err != nil || !reflect.DeepEqual(got, MetaItem{}) {
+		t.Error("empty MetaItem should round trip, got", got, err)
+	}
+
+	v := variants{Varies: [][]string{{"Accept-Language", "Cookie"}, {}}, Keys: [][]byte{[]byte("a\x00vary\x00ff"), []byte("a")}}
+	if got, err := decodevariants(encodevariants(v)); err != nil || !reflect.DeepEqual(got, v) {
+		t.Error("variants should round trip, got", got, err)
+	}
+
+	sliced := sliceditem{Meta: meta, Size: 1 << 40, Version: `"5e5b9a4c-1400"`, SliceSize: 1 << 20}
+	if got, err := decodesliced(encodesliced(sliced)); err != nil || !reflect.DeepEqual(got, sliced) {
+		t.Error("sliceditem should round trip, got", got, err)
+	}
+}
+
+func Test_MetaCodecCorrupt(t *testing.T) {
+	encoded := encodemeta(testmeta())
+	for i := 0; i < len(encoded); i++ {
+		if _, err := decodemeta(encoded[:i]); err != errmetaformat {
+			t.Error("truncated to", i, "bytes should be errmetaformat, got", err)
+		}
+	}
+	if _, err := decodemeta(append(encoded, 0)); err != errmetaformat {
+		t.Error("trailing garbage should be errmetaformat, got", err)
+	}
+	//As stored before, in metacache
+	var buffer bytes.Buffer
+	meta := testmeta()
+	gob.NewEncoder(&buffer).Encode(&meta)
+	if _, err := decodemeta(buffer.Bytes()); err != errmetaformat {
+		t.Error("gob should be errmetaformat, got", err)
+	}
+	//A huge count must not be allocated for
+	if _, err := decodevariants([]byte{variantsversion, 0xff, 0xff, 0xff, 0xff, 0x0f}); err != errmetaformat {
+		t.Error("huge count should be errmetaformat, got", err)
+	}
+}
+
+func Benchmark_MetaGob(b *testing.B) {
+	meta := testmeta()
+	var size int
+	for i := 0; i < b.N; i++ {
+		var buffer bytes.Buffer
+		gob.NewEncoder(&buffer).Encode(&meta)
+		size = buffer.Len()
+		var decoded MetaItem
+		gob.NewDecoder(&buffer).Decode(&decoded)
+	}
+	b.ReportMetric(float64(size), "bytes/entry")
+}
+
+func Benchmark_MetaCodec(b *testing.B) {
+	meta := testmeta()
+	var size int
+	for i := 0; i < b.N; i++ {
+		encoded := encodemeta(meta)
+		size = len(encoded)
+		decodemeta(encoded)
+	}
+	b.ReportMetric(float64(size), "bytes/entry")
+}
@@ -2,14 +2,14 @@ package goproxy
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"context"
 	"fmt"
 	"github.com/dchest/uniuri"
-	"github.com/valyala/ybc/bindings/go/ybc"
+	"github.com/sajal/gohttpcache/cache"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -20,37 +20,76 @@ var (
 	confignotfound = []byte("Requested hostname is not configured.\n")
 	backenderr     = []byte("Error requesting to backend.\n")
 	backendslow    = []byte("Backend too slow.\n")
+	notincache     = []byte("Not in cache.\n")
 )
 
+//How long objects are kept past their freshness lifetime, for revalidation
+const staleretention = 24 * time.Hour
+
 //Cached items have this preceeding the object body
 type MetaItem struct {
-	Header  http.Header
-	ObjKey  []byte
-	Fetched time.Time
-	Status  int
+	Header    http.Header
+	ObjKey    []byte
+	Fetched   time.Time //When the response was received from origin
+	Status    int
+	Requested time.Time //When the request to origin was sent
+
+	Lifetime       time.Duration //Freshness lifetime
+	MustRevalidate bool          //Response may not be served stale
+
+	StaleWhileRevalidate time.Duration //How long past Lifetime we serve stale while refreshing in background
+	StaleIfError         time.Duration //How long past Lifetime we serve stale when origin fails
+}
+
+//Current age of the cached response, rfc7234 section 4.2.3
+func (self *MetaItem) age(now time.Time) time.Duration {
+	return gohttpcache.CurrentAge(self.Header, self.Requested, self.Fetched, now)
+}
+
+//Take freshness and staleness of the response from the Determiner
+func (self *MetaItem) apply(decision gohttpcache.Decision) {
+	self.Lifetime = decision.TTL
+	self.MustRevalidate = !decision.Stale
+	self.StaleWhileRevalidate = decision.StaleWhileRevalidate
+	self.StaleIfError = decision.StaleIfError
 }
 
 //We use this object to pass around args thru the stack
 type transaction struct {
-	clientreq  *http.Request //Stashing the original client req
-	respwriter http.ResponseWriter
-	started    time.Time
-	logid      string        //A unique identifier in logs and resp header
-	hit        bool          //true if it was cache hit
-	origintime time.Duration //Time taken to fetch from origin
-	metakey    []byte
-	objkey     []byte
+	clientreq   *http.Request //Stashing the original client req
+	respwriter  http.ResponseWriter
+	started     time.Time
+	logid       string        //A unique identifier in logs and resp header
+	hit         bool          //true if it was cache hit
+	revalidated bool          //true if a stale hit was revalidated with origin
+	stale       bool          //true if served stale, rfc5861
+	collapsed   bool          //true if served from another client's fetch
+	tier        string        //Tier of a TieredStore the object was found in
+	origintime  time.Duration //Time taken to fetch from origin
+	metakey     []byte
+	objkey      []byte
+	policy      gohttpcache.RequestPolicy //Client's Cache-Control directives
+	flight      *flight                   //Fetch we lead that others may join
+	stamped     bool                      //true once the response headers are final, see stamp
 }
 
 func (self *transaction) log(args ...interface{}) {
 	log.Println(self.logid, args)
 }
 
+//Add our headers to the response, right before its status is written
 func (self *transaction) stamp() {
+	self.stamped = true
 	self.respwriter.Header().Set("X-GP-Timetaken", time.Since(self.started).String())
 	self.respwriter.Header().Set("X-GP-Debug", self.logid)
-	if self.hit {
-		self.respwriter.Header().Set("X-GP-Cache", "HIT")
+	if self.revalidated {
+		self.respwriter.Header().Set("X-GP-Cache", "REVALIDATED in "+self.origintime.String())
+	} else if self.collapsed {
+		self.respwriter.Header().Set("X-GP-Cache", "COLLAPSED in "+self.origintime.String())
+	} else if self.stale {
+		self.respwriter.Header().Set("X-GP-Cache", strings.TrimSpace("STALE "+self.tier))
+	} else if self.hit {
+		self.respwriter.Header().Set("X-GP-Cache", strings.TrimSpace("HIT "+self.tier))
 	} else {
 		self.respwriter.Header().Set("X-GP-Cache", "MISS in "+self.origintime.String())
 	}
@@ -58,6 +97,16 @@ func (self *transaction) stamp() {
 
 func (self *transaction) servebody(meta MetaItem, item io.ReadCloser) {
 	defer item.Close()
+	if status := gohttpcache.Preconditions(self.clientreq.Method, self.clientreq.Header, meta.Status, meta.Header); status != 0 {
+		self.servestatus(meta, status)
+		return
+	}
+	var body io.Reader = item
+	transformed, tbody := self.transform(meta, item)
+	if tbody != nil {
+		defer tbody.Close()
+		meta, body = transformed, tbody
+	}
 	for k, v := range meta.Header {
 		if k != http.CanonicalHeaderKey("Date") || k != http.CanonicalHeaderKey("Transfer-Encoding") { //Strip out Date header from cache. Let Go put that in
 			for _, val := range v {
@@ -65,7 +114,13 @@ func (self *transaction) servebody(meta MetaItem, item io.ReadCloser) {
 			}
 		}
 	}
-	self.respwriter.Header().Set("Age", fmt.Sprintf("%9.f", time.Since(meta.Fetched).Seconds()))
+	self.respwriter.Header().Set("Age", gohttpcache.FormatAge(meta.age(time.Now())))
+	if meta.Status == http.StatusOK && tbody == nil {
+		self.respwriter.Header().Set("Accept-Ranges", "bytes")
+		if self.serveranges(meta, body) {
+			return
+		}
+	}
 	self.stamp()
 	self.respwriter.WriteHeader(meta.Status)
 	/*
@@ -76,25 +131,61 @@ func (self *transaction) servebody(meta MetaItem, item io.ReadCloser) {
 			self.log("No flush available")
 		}
 	*/
-	io.Copy(self.respwriter, item)
+	io.Copy(self.respwriter, body)
 
 	//Stamp response
 }
 
-func (self *transaction) serve(item io.ReadCloser) {
-	//Write headers...
-	meta, err := loadmeta(item)
-	if err != nil {
-		self.log(err)
-		self.fail(err)
-		item.Close()
-		return
+//Headers sent along with a 304 Not Modified, rfc7232 section 4.1
+var notmodifiedheaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary"}
+
+//Answer the client's conditional request with 304 or 412 instead of the body
+func (self *transaction) servestatus(meta MetaItem, status int) {
+	if status == http.StatusNotModified {
+		for _, k := range notmodifiedheaders {
+			for _, val := range meta.Header[http.CanonicalHeaderKey(k)] {
+				self.respwriter.Header().Add(k, val)
+			}
+		}
+	}
+	self.respwriter.Header().Set("Age", gohttpcache.FormatAge(meta.age(time.Now())))
+	self.stamp()
+	self.respwriter.WriteHeader(status)
+}
+
+//Client asked for only-if-cached and we have nothing suitable, rfc7234 section 5.2.1.7
+func (self *transaction) notcached() {
+	self.stamp()
+	self.respwriter.WriteHeader(http.StatusGatewayTimeout)
+	self.respwriter.Write(notincache)
+}
+
+//unstorable explains why a response from origin must not be stored, or
+//returns an empty string if it can be.
+func (self *transaction) unstorable(status int, decision gohttpcache.Decision) string {
+	if !decision.Cache || !decision.Store {
+		if len(decision.Reasons) == 0 {
+			return "not cacheable"
+		}
+		return decision.Reasons[len(decision.Reasons)-1]
+	}
+	if status == http.StatusPartialContent {
+		//We only store complete objects
+		return "partial content"
 	}
-	self.servebody(meta, item)
+	return ""
 }
 
+//Tell the client origin failed us. Once the status is out, all we can do is
+//abort the response, so the client does not take what it got for complete.
 func (self *transaction) fail(err error) {
-	//TODO: send booboo to user.
+	self.log("origin failed:", err)
+	if self.stamped {
+		panic(http.ErrAbortHandler)
+	}
+	self.stamp()
+	self.respwriter.WriteHeader(http.StatusBadGateway)
+	self.respwriter.Write(backenderr)
 }
 
 func newrequest(w http.ResponseWriter, r *http.Request) *transaction {
@@ -105,6 +196,7 @@ func newrequest(w http.ResponseWriter, r *http.Request) *transaction {
 	txn.started = time.Now()
 	txn.logid = uniuri.NewLen(12) // Generate some sort of uuid
 	txn.origintime = time.Duration(0)
+	txn.policy = gohttpcache.ParseRequestPolicy(r.Header)
 	return txn
 }
 
@@ -124,14 +216,17 @@ func QSIgnoreKeyFunc(r *http.Request, id string) (key []byte) {
 
 //Struct that a user defines for a service
 type Service struct {
-	Name        string                                        //Descriptive name of the service
-	Id          string                                        //ID Unique..
-	Origin      string                                        //Hostname to resolve for connection to origin
-	OriginHost  string                                        //Host header used when requesting to origin
-	OriginTLS   bool                                          //Weather to use https when connecting to origin or not.
-	Hostnames   []string                                      //Hostnames to serve content from
-	BaseKeyFunc func(r *http.Request, id string) (key []byte) //Default key building function
-	client      http.RoundTripper                             //One client per service
+	Name            string                                        //Descriptive name of the service
+	Id              string                                        //ID Unique..
+	Origin          string                                        //Hostname to resolve for connection to origin
+	OriginHost      string                                        //Host header used when requesting to origin
+	OriginTLS       bool                                          //Weather to use https when connecting to origin or not.
+	Hostnames       []string                                      //Hostnames to serve content from
+	BaseKeyFunc     func(r *http.Request, id string) (key []byte) //Default key building function
+	VaryNormalizers map[string]VaryNormalizer                     //By canonical header name, Accept-Encoding defaults to NormalizeAcceptEncoding
+	Determiner      *gohttpcache.Determiner                       //Decides what is stored and for how long, a public Determiner if nil. Only GET and HEAD are ever cached.
+	SliceSize       int64                                         //Fetch and cache objects in slices of this many bytes, 0 to disable
+	client          http.RoundTripper                             //One client per service
 }
 
 //Call the BaseKeyFunc
@@ -139,28 +234,53 @@ func (self *Service) getbasekey(r *http.Request) []byte {
 	return self.BaseKeyFunc(r, self.Id)
 }
 
+//Ask the Determiner about a response to the client's request
+func (self *Service) decide(req *transaction, status int, reshdrs http.Header) gohttpcache.Decision {
+	return self.Determiner.Decide(req.clientreq.Method, status, req.clientreq.Header, reshdrs)
+}
+
 //The main proxyserver handler
 type ProxyServer struct {
 	configs     map[string]*Service //Thread safe for read only. TODO: locking for updates...
-	objcache    *ybc.Cache          //Thread safe
-	metacache   *ybc.Cache          //Thread safe
-	configmutex sync.RWMutex        //FUTURE: We will use this for locking to do updates
-}
-
-//Creates a new ProxyServer
-//services : list of ServiceConfig
-//cachedir: directory to store the cache
-//metacachesize: Size (in MB) of metadata particularly vary info
-//objcachesize: Size (in MB) of actual cache objects
-//maxitems: Max items in each cache
-func NewProxyServer(services []Service, cachedir string, metacachesize, objcachesize, maxitems int) *ProxyServer {
+	objcache    Store               //Objects, metadata followed by the body
+	metacache   Store               //Variants, refreshed and sliced metadata
+	spooldir    string              //Where bodies of unknown size are spooled before storing
+	flights     map[string]*flight  //Origin fetches in progress, by objkey
+	flightmutex sync.Mutex
+	index       *purgeindex    //What is stored per URL and surrogate key
+	bans        *banlist       //Invalidations checked on lookup
+	configmutex sync.RWMutex   //FUTURE: We will use this for locking to do updates
+	closing     chan struct{}  //Closed by Close, stops saving the index
+	saved       chan struct{}  //Closed once the index is no longer saved in background
+	refreshes   sync.WaitGroup //Background refreshes in progress
+	server      *http.Server   //Started by ListenAndServe
+	shutdown    bool           //No more serving, see Shutdown
+	servermutex sync.Mutex
+
+	variantmutexes [variantstripes]sync.Mutex //See lockvariants
+}
+
+//NewProxyServerWithStores creates a ProxyServer keeping objects and metadata
+//in the given stores. Bodies of unknown size are spooled in spooldir before
+//they are stored.
+func NewProxyServerWithStores(services []Service, objstore, metastore Store, spooldir string) *ProxyServer {
 	proxy := &ProxyServer{}
 	proxy.configs = make(map[string]*Service)
+	proxy.objcache = objstore
+	proxy.metacache = metastore
+	proxy.spooldir = spooldir
+	proxy.flights = make(map[string]*flight)
+	proxy.index = newpurgeindex()
+	proxy.bans = &banlist{store: metastore}
 	for _, service := range services {
 		if service.BaseKeyFunc == nil {
 			log.Println(service.Id, "BaseKeyFunc not found using DefaultBaseKeyFunc")
 			service.BaseKeyFunc = DefaultBaseKeyFunc
 		}
+		if service.Determiner == nil {
+			determiner := gohttpcache.NewPublicDeterminer()
+			service.Determiner = &determiner
+		}
 		service.client = &http.Transport{
 			MaxIdleConnsPerHost: 10, //10 idle connections max
 			//TLSHandshakeTimeout:   time.Minute, //1 minute timeout for TLS handshake.
@@ -170,29 +290,56 @@ func NewProxyServer(services []Service, cachedir string, metacachesize, objcache
 			proxy.configs[hostname] = &service
 		}
 	}
+	//Objects recovered from an earlier run can be banned until they expire.
+	//The bans saved with them know when that is, stores may know better.
+	report := proxy.StartupReport()
+	log.Println("object store", report.Objects)
+	log.Println("metadata store", report.Metadata)
+	proxy.bans.load()
+	proxy.bans.stored(report.Objects.Expires)
+	proxy.bans.stored(report.Metadata.Expires)
+	proxy.index.load(metastore)
+	proxy.closing = make(chan struct{})
+	proxy.saved = make(chan struct{})
+	go proxy.index.autosave(metastore, indexsaveinterval, proxy.closing, proxy.saved)
+	return proxy
+}
 
-	metacfg := ybc.Config{
-		MaxItemsCount: ybc.SizeT(maxitems),
-		DataFileSize:  ybc.SizeT(metacachesize) * ybc.SizeT(1024*1024),
-		DataFile:      cachedir + "goproxy-meta.data",
-		IndexFile:     cachedir + "goproxy-meta.index",
-	}
-	var err error
-	proxy.metacache, err = metacfg.OpenCache(true)
-	if err != nil {
-		log.Fatal(err)
-	}
-	objcfg := ybc.Config{
-		MaxItemsCount: ybc.SizeT(maxitems),
-		DataFileSize:  ybc.SizeT(objcachesize) * ybc.SizeT(1024*1024),
-		DataFile:      cachedir + "goproxy-obj.data",
-		IndexFile:     cachedir + "goproxy-obj.index",
+//StartupReport tells what the stores of a ProxyServer recovered from an
+//earlier run
+type StartupReport struct {
+	Objects  StoreReport
+	Metadata StoreReport
+}
+
+//StartupReport tells what was recovered when the ProxyServer was created.
+//Stores that are not a Recoverer report starting empty.
+func (self *ProxyServer) StartupReport() StartupReport {
+	return StartupReport{Objects: recovered(self.objcache), Metadata: recovered(self.metacache)}
+}
+
+func recovered(store Store) StoreReport {
+	if r, ok := store.(Recoverer); ok {
+		return r.Recovered()
 	}
-	proxy.objcache, err = objcfg.OpenCache(true)
-	if err != nil {
-		log.Fatal(err)
+	return StoreReport{}
+}
+
+//Close saves the purge index and closes the stores that need it, so the next
+//run finds them intact. Call it once the server is done serving, or use
+//Shutdown.
+func (self *ProxyServer) Close() (err error) {
+	close(self.closing)
+	<-self.saved
+	err = self.index.save(self.metacache)
+	for _, store := range []Store{self.objcache, self.metacache} {
+		if c, ok := store.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil {
+				err = cerr
+			}
+		}
 	}
-	return proxy
+	return
 }
 
 //default handler
@@ -212,33 +359,77 @@ func (self *ProxyServer) handler(w http.ResponseWriter, r *http.Request) {
 
 //Service is known, now proceed to check cache
 func (self *ProxyServer) cachehandler(req *transaction, service *Service) {
-	req.metakey = service.getbasekey(req.clientreq)
-	req.log("basekey", string(req.metakey))
-	vary, err := self.getvary(req.metakey)
-	req.objkey = req.metakey
-	if err == nil {
-		//Known vary keys exists, apply it
-		req.objkey = self.appendvary(req.metakey, req.clientreq.Header, vary)
-	} else {
-		req.log("getvary", err)
+	if !req.cacheable() {
+		self.forward(req, service)
+		return
 	}
+	req.metakey = authorizedkey(service.getbasekey(req.clientreq), req.clientreq)
+	req.log("basekey", string(req.metakey))
+	item, err := self.lookup(req, service)
 	req.log("objkey", string(req.objkey))
-	item, err := self.objcache.GetItem(req.objkey)
 	req.log("cachehandler exit")
 	if err == nil {
-		//Yay cache hit...
-		req.hit = true
-		req.serve(item)
-		//item.Close()
-	} else {
-		self.handlecachemiss(req, service)
+		meta, body, err := self.loadentry(req.objkey, item)
+		if err != nil {
+			req.log("loadentry", err)
+			item.Close()
+		} else if meta = self.loadrefreshed(req.objkey, meta); self.checkbans(req, meta) {
+			//Invalidated since it was stored
+			item.Close()
+		} else {
+			age := meta.age(time.Now())
+			if req.policy.Acceptable(meta.Lifetime, age, meta.MustRevalidate) {
+				//Yay cache hit...
+				req.hit = true
+				req.servebody(meta, body)
+				return
+			}
+			if meta.StaleWhileRevalidate > 0 && req.policy.Acceptable(meta.Lifetime+meta.StaleWhileRevalidate, age, false) {
+				//Serve stale right away, and refresh for the next client
+				self.refreshinbackground(req, service, meta)
+				req.servestale(meta, body, gohttpcache.StaleWarning)
+				return
+			}
+			if (hasvalidators(meta) || meta.StaleIfError > 0) && !req.policy.OnlyIfCached {
+				//Stale, or client wants it checked. Ask origin if our copy is still good
+				self.revalidate(req, service, meta, body)
+				return
+			}
+			req.log("cached copy not acceptable to client")
+			item.Close()
+		}
+	}
+	if req.policy.OnlyIfCached {
+		//Sliced objects are not in objcache as a whole
+		if service.SliceSize > 0 && req.sliceable() {
+			if _, served, _ := self.servecachedslices(req, service); served {
+				return
+			}
+		}
+		req.notcached()
+		return
 	}
+	self.handlecachemiss(req, service)
 }
 
 //Object not in cache... fetch from origin...
 func (self *ProxyServer) handlecachemiss(req *transaction, service *Service) {
 	req.hit = false
-	//TODO: Get binary stream from fetchorigin, and using buffers, tee one stream to serve and one to insert in cache
+	if service.SliceSize > 0 && req.sliceable() {
+		self.serveslices(req, service)
+		return
+	}
+	if !req.policy.NoStore {
+		f, leader := self.joinflight(req.objkey)
+		if !leader {
+			if self.follow(req, service, f) {
+				return
+			}
+		} else {
+			req.flight = f
+			defer self.land(req.objkey, f)
+		}
+	}
 	_, _, _, err := self.fetchfromorigin(req, service)
 	if err != nil {
 		req.fail(err)
@@ -250,172 +441,253 @@ func (self *ProxyServer) handlecachemiss(req *transaction, service *Service) {
 func (self *ProxyServer) fetchfromorigin(req *transaction, service *Service) (key []byte, ttl time.Duration, buf bytes.Buffer, err error) {
 	//TODO... fetch from origin, and push data in binary stream as per our item thing...
 	fetchstart := time.Now()
-	var url string
-	if service.OriginTLS {
-		url = fmt.Sprintf("https://%s%s", service.Origin, req.clientreq.RequestURI)
-	} else {
-		url = fmt.Sprintf("http://%s%s", service.Origin, req.clientreq.RequestURI)
-	}
-	originreq, err := http.NewRequest(req.clientreq.Method, url, nil)
+	originreq, err := originrequest(req, service)
 	if err != nil {
 		return
 	}
-	originreq.Host = service.OriginHost
-	for k, v := range req.clientreq.Header {
-		if k != http.CanonicalHeaderKey("Host") {
-			for _, val := range v {
-				originreq.Header.Add(k, val)
-			}
-		}
-	}
 	resp, err := service.client.RoundTrip(originreq)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
+	key, err = self.storeresponse(req, service, resp, fetchstart)
+	return
+}
 
-	var buffer bytes.Buffer
-	hdrobj := &MetaItem{Header: resp.Header, Status: resp.StatusCode, Fetched: time.Now()}
-	enc := gob.NewEncoder(&buffer)
-	err = enc.Encode(hdrobj)
-	if err != nil {
-		return
-	}
-	hdrbyt := buffer.Bytes()
-
-	//Update vary things...
-	var vary []string
-	for _, k := range strings.Split(resp.Header.Get("Vary"), ",") {
-		vary = append(vary, http.CanonicalHeaderKey(strings.Trim(k, " ")))
-	}
-
-	var metabuffer bytes.Buffer
-	metaenc := gob.NewEncoder(&metabuffer)
-	err = metaenc.Encode(vary)
+//Requests other than GET and HEAD go to origin as the client sent them, body
+//included, and its response is relayed as is. They are never answered from
+//cache, even if the Determiner allows caching their responses, and
+//preconditions on them are for origin to evaluate.
+func (self *ProxyServer) forward(req *transaction, service *Service) {
+	fetchstart := time.Now()
+	originreq, err := originrequest(req, service)
 	if err != nil {
+		req.fail(err)
 		return
 	}
-	self.metacache.Set(req.metakey, metabuffer.Bytes(), ybc.MaxTtl)
-	key = self.appendvary(req.metakey, req.clientreq.Header, vary)
-
+	resp, err := service.client.RoundTrip(originreq)
 	if err != nil {
+		req.fail(err)
 		return
 	}
+	defer resp.Body.Close()
 	req.origintime = time.Since(fetchstart)
-	//_, err = io.Copy(&buf, resp.Body)
-	rdr := NewSpyReader(resp.Body)
-	cdone := make(chan bool)
-	go func() {
-		//Spoonfeed maybe
-		req.servebody(*hdrobj, rdr)
-		cdone <- true
-	}()
-	storeincache(key, time.Minute, hdrbyt, rdr, self.objcache)
-	if err != nil {
-		return
+	if req.unsafe() && resp.StatusCode < 400 {
+		self.invalidate(req, resp)
 	}
-	<-cdone
-	return
+	for k, v := range resp.Header {
+		for _, val := range v {
+			req.respwriter.Header().Add(k, val)
+		}
+	}
+	req.stamp()
+	req.respwriter.WriteHeader(resp.StatusCode)
+	io.Copy(req.respwriter, resp.Body)
 }
 
-func storeincache(key []byte, ttl time.Duration, hdrbyt []byte, item *SpyReader, cache *ybc.Cache) {
-	body, err := item.Dump()
-	if err != nil {
-		log.Println(string(key), err)
-	}
-	itemsize := len(body) + len(hdrbyt) + 2
+//Only responses to GET and HEAD are served from cache
+func (self *transaction) cacheable() bool {
+	return self.clientreq.Method == "GET" || self.clientreq.Method == "HEAD"
+}
 
-	txn, err := cache.NewSetTxn(key, itemsize, ttl)
-	if err != nil {
-		log.Println(string(key), err)
-		return
+//Methods that may change things at origin, rfc7231 section 4.2.1
+func (self *transaction) unsafe() bool {
+	switch self.clientreq.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
 	}
-	err = storeheaders(hdrbyt, txn)
+	return true
+}
+
+//A successful unsafe request invalidates what we have of its URL, and of
+//the URLs on the same host that Location and Content-Location point to,
+//rfc7234 section 4.4
+func (self *ProxyServer) invalidate(req *transaction, resp *http.Response) {
+	base, err := url.ParseRequestURI(req.clientreq.RequestURI)
 	if err != nil {
-		log.Println(string(key), err)
-		txn.Rollback()
 		return
 	}
-	n, err := txn.Write(body)
-	if err != nil {
-		txn.Rollback()
-		return
+	uris := []string{req.clientreq.RequestURI}
+	for _, h := range []string{"Location", "Content-Location"} {
+		location, err := url.Parse(resp.Header.Get(h))
+		if err != nil || location.String() == "" || (location.Host != "" && location.Host != req.clientreq.Host) {
+			continue
+		}
+		uris = append(uris, base.ResolveReference(location).RequestURI())
 	}
-	log.Println(string(key), n, "bytes written")
-	err = txn.Commit()
-	if err != nil {
-		log.Println(string(key), err)
-	} else {
-		log.Println(string(key), "stored successfully in cache. yay")
+	for _, uri := range dedupe(uris) {
+		if n := self.PurgeURL(req.clientreq.Host, uri, false); n > 0 {
+			req.log("invalidated", uri, n)
+		}
 	}
 }
 
-func storeheaders(hdrbyt []byte, w io.Writer) (err error) {
-	if len(hdrbyt) > 65025 {
-		//TODO err
+//Client preconditions and ranges on requests we may answer from cache are
+//evaluated by us against the full response, so we do not pass them to origin.
+var clientconditionals = map[string]bool{
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+	"If-Range":            true,
+	"Range":               true,
+}
+
+//Build the request to origin on behalf of the client
+func originrequest(req *transaction, service *Service) (originreq *http.Request, err error) {
+	var url string
+	if service.OriginTLS {
+		url = fmt.Sprintf("https://%s%s", service.Origin, req.clientreq.RequestURI)
+	} else {
+		url = fmt.Sprintf("http://%s%s", service.Origin, req.clientreq.RequestURI)
 	}
-	var hdrsize int16 = int16(len(hdrbyt))
-	err = binary.Write(w, binary.LittleEndian, hdrsize)
+	originreq, err = http.NewRequest(req.clientreq.Method, url, nil)
 	if err != nil {
 		return
 	}
-	_, err = w.Write(hdrbyt)
+	if !req.cacheable() {
+		originreq.Body = req.clientreq.Body
+		originreq.ContentLength = req.clientreq.ContentLength
+	}
+	originreq.Host = service.OriginHost
+	strip := req.cacheable()
+	for k, v := range req.clientreq.Header {
+		if k != http.CanonicalHeaderKey("Host") && !(strip && clientconditionals[k]) {
+			for _, val := range v {
+				originreq.Header.Add(k, val)
+			}
+		}
+	}
+	//One stored representation serves every client, see transform
+	originreq.Header.Set("Accept-Encoding", originencoding(req.clientreq.Header))
 	return
 }
 
-func loadmeta(r io.Reader) (hdr MetaItem, err error) {
-	var sizebuf [2]byte
-	_, err = r.Read(sizebuf[:])
-	if err != nil {
+//Serve a full response from origin to the client, storing it in cache when allowed
+func (self *ProxyServer) storeresponse(req *transaction, service *Service, resp *http.Response, fetchstart time.Time) (key []byte, err error) {
+	hdrobj := &MetaItem{Header: resp.Header, Status: resp.StatusCode, Fetched: time.Now(), Requested: fetchstart}
+	decision := service.decide(req, resp.StatusCode, resp.Header)
+	if decision.Warning != "" {
+		resp.Header.Add("Warning", decision.Warning)
+	}
+	hdrobj.apply(decision)
+	if reason := req.unstorable(resp.StatusCode, decision); reason != "" {
+		//Pass it thru without storing
+		req.log("not storing:", reason)
+		if req.flight != nil {
+			req.flight.ground()
+		}
+		req.origintime = time.Since(fetchstart)
+		req.servebody(*hdrobj, resp.Body)
 		return
 	}
-	buf := bytes.NewReader(sizebuf[:])
-	var hdrsize int16
-	err = binary.Read(buf, binary.LittleEndian, &hdrsize)
+	storedobj := storedmeta(*hdrobj, decision)
+	hdrbyt := encodemeta(storedobj)
+	//Keep stale objects around so they can be revalidated
+	ttl := hdrobj.Lifetime + staleretention
+
+	key, err = self.storevariant(req, service, resp.Header, ttl)
 	if err != nil {
 		return
 	}
-	hdrbytes := make([]byte, hdrsize)
-	_, err = r.Read(hdrbytes)
+	req.origintime = time.Since(fetchstart)
+	size := resp.ContentLength
+	if req.clientreq.Method == "HEAD" {
+		size = 0
+	}
+	body := resp.Body
+	if req.flight != nil {
+		body = req.flight.takeoff(storedobj, key, body, self.spooldir)
+	}
+	self.bans.stored(time.Now().Add(ttl))
+	fill, err := newcachefill(self.objcache, key, ttl, hdrbyt, size, self.spooldir)
 	if err != nil {
+		//Still serve the client, just without storing
+		req.log("not storing:", err)
+		req.servebody(*hdrobj, body)
+		err = nil
 		return
 	}
-	rdr := bytes.NewReader(hdrbytes)
-	dec := gob.NewDecoder(rdr)
-	//start := time.Now()
-	err = dec.Decode(&hdr)
+	self.servefill(req, *hdrobj, body, fill)
 	return
 }
 
-//Service is known, now proceed to check cache
-func (self *ProxyServer) getvary(key []byte) (vary []string, err error) {
-	m, err := self.metacache.Get(key)
-	if err != nil {
-		return
-	}
-	rdr := bytes.NewReader(m)
-	dec := gob.NewDecoder(rdr)
-	err = dec.Decode(&vary)
-	if err != nil {
-		return
+//Fields the Determiner found in qualified no-cache or private directives are
+//not stored, only the client that triggered the fetch gets them. Same for
+//Set-Cookie, cookies are meant for that client alone.
+func storedmeta(meta MetaItem, decision gohttpcache.Decision) MetaItem {
+	fields := append(append([]string(nil), decision.NoCacheFields...), decision.PrivateFields...)
+	if _, ok := meta.Header[http.CanonicalHeaderKey("Set-Cookie")]; ok {
+		fields = append(fields, "Set-Cookie")
+	}
+	if len(fields) > 0 {
+		meta.Header = meta.Header.Clone()
+		for _, f := range fields {
+			meta.Header.Del(f)
+		}
 	}
-	return
+	return meta
 }
 
-func (self *ProxyServer) appendvary(key []byte, headers http.Header, vary []string) []byte {
-	for _, k := range vary {
-		key = append([]byte(headers.Get(k)), key...)
+//Responses to authenticated requests are keyed apart from anonymous ones, so
+//anonymous clients are never served something fetched with credentials, and
+//authenticated clients never get the anonymous version.
+func authorizedkey(key []byte, r *http.Request) []byte {
+	if isauthorized(r) {
+		key = append(key, []byte("\x00authorized")...)
 	}
 	return key
 }
 
-//Start the proxy server
+func isauthorized(r *http.Request) bool {
+	_, ok := r.Header[http.CanonicalHeaderKey("Authorization")]
+	return ok
+}
+
+//Start the proxy server. Blocks until Shutdown, then returns
+//http.ErrServerClosed.
 func (self *ProxyServer) ListenAndServe(addr string, readtimeout time.Duration) (err error) {
 	srv := &http.Server{
 		Addr:        addr,
 		Handler:     http.HandlerFunc(self.handler),
 		ReadTimeout: readtimeout,
 	}
-	err = srv.ListenAndServe() //blocks forever
+	self.servermutex.Lock()
+	if self.shutdown {
+		self.servermutex.Unlock()
+		return http.ErrServerClosed
+	}
+	self.server = srv
+	self.servermutex.Unlock()
+	err = srv.ListenAndServe()
+	return
+}
+
+//Shutdown stops ListenAndServe and waits for the requests in progress, and
+//background refreshes, to finish before closing the stores. Whatever is
+//still running once ctx is done has its connection closed.
+func (self *ProxyServer) Shutdown(ctx context.Context) (err error) {
+	self.servermutex.Lock()
+	self.shutdown = true
+	srv := self.server
+	self.servermutex.Unlock()
+	if srv != nil {
+		if err = srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}
+	refreshed := make(chan struct{})
+	go func() {
+		self.refreshes.Wait()
+		close(refreshed)
+	}()
+	select {
+	case <-refreshed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if cerr := self.Close(); cerr != nil {
+		err = cerr
+	}
 	return
 }
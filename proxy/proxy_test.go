@@ -0,0 +1,351 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/sajal/gohttpcache/cache"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//A ProxyServer in front of a test origin, storing in memory
+type testproxy struct {
+	*ProxyServer
+	origin  *httptest.Server
+	fetches int32
+}
+
+func newtestproxy(t *testing.T, handler http.HandlerFunc, configure ...func(*Service)) *testproxy {
+	p := &testproxy{}
+	p.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&p.fetches, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(p.origin.Close)
+	service := Service{Id: "t", Origin: p.origin.Listener.Addr().String(), Hostnames: []string{"example.com"}}
+	for _, c := range configure {
+		c(&service)
+	}
+	p.ProxyServer = NewProxyServerWithStores([]Service{service}, NewMemoryStore(1<<20), NewMemoryStore(1<<20), t.TempDir())
+	return p
+}
+
+//Send a request thru the proxy, hdr is pairs of header names and values
+func (self *testproxy) do(method, path, body string, hdr ...string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body == "" {
+		r = httptest.NewRequest(method, path, nil)
+	} else {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+	}
+	r.Host = "example.com"
+	for i := 0; i+1 < len(hdr); i += 2 {
+		r.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	self.handler(w, r)
+	return w
+}
+
+func (self *testproxy) get(path string, hdr ...string) *httptest.ResponseRecorder {
+	return self.do("GET", path, "", hdr...)
+}
+
+//How many requests origin got, resetting the count
+func (self *testproxy) fetched() int {
+	return int(atomic.SwapInt32(&self.fetches, 0))
+}
+
+//First word of X-GP-Cache, HIT, MISS and so on
+func cachestatus(w *httptest.ResponseRecorder) string {
+	fields := strings.Fields(w.Header().Get("X-GP-Cache"))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func readbody(w *httptest.ResponseRecorder) string {
+	b, _ := io.ReadAll(w.Result().Body)
+	return string(b)
+}
+
+func Test_ForwardUnsafe(t *testing.T) {
+	var deleted int32
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			if r.Header.Get("If-Match") != `"v2"` {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			atomic.AddInt32(&deleted, 1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("Range") != "" {
+			t.Error("conditionals on a GET should be evaluated by the proxy, origin got", r.Header)
+		}
+		w.Write([]byte("doc"))
+	})
+	if w := p.get("/doc", "If-None-Match", `"v1"`); w.Code != http.StatusNotModified {
+		t.Error("GET matching the ETag should be answered 304, got", w.Code)
+	}
+	if w := p.do("DELETE", "/doc", "", "If-Match", `"v1"`); w.Code != http.StatusPreconditionFailed {
+		t.Error("DELETE should get origin's 412, got", w.Code)
+	}
+	if w := p.do("DELETE", "/doc", "", "If-Match", `"v2"`); w.Code != http.StatusNoContent {
+		t.Error("DELETE should get origin's 204, got", w.Code)
+	}
+	if n := atomic.LoadInt32(&deleted); n != 1 {
+		t.Error("origin should see If-Match and delete once, deleted", n, "times")
+	}
+}
+
+func Test_UnsafeInvalidates(t *testing.T) {
+	var posted atomic.Value
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Method == "POST" {
+			b, _ := io.ReadAll(r.Body)
+			posted.Store(string(b))
+			w.Header().Set("Location", "/items/1")
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte(r.Method))
+	}, func(service *Service) {
+		//Even when asked to, cached POST responses never answer POSTs
+		d := gohttpcache.NewPublicDeterminer().With(gohttpcache.WithMethods("GET", "HEAD", "POST"))
+		service.Determiner = &d
+	})
+	for _, path := range []string{"/items", "/items/1", "/other"} {
+		p.get(path)
+		if w := p.get(path); cachestatus(w) != "HIT" {
+			t.Fatal(path, "should be cached, got", cachestatus(w))
+		}
+	}
+	p.fetched()
+	for i := 0; i < 2; i++ {
+		if w := p.do("POST", "/items", "item"); w.Code != http.StatusCreated || readbody(w) != "POST" {
+			t.Error("POST should be answered by origin, got", w.Code, readbody(w))
+		}
+		if got, _ := posted.Load().(string); got != "item" {
+			t.Error("POST body should reach origin, got", got)
+		}
+	}
+	if n := p.fetched(); n != 2 {
+		t.Error("every POST should go to origin, got", n)
+	}
+	for path, status := range map[string]string{"/items": "MISS", "/items/1": "MISS", "/other": "HIT"} {
+		if w := p.get(path); cachestatus(w) != status || readbody(w) != "GET" {
+			t.Error(path, "should be", status, "after the POST, got", cachestatus(w), readbody(w))
+		}
+	}
+}
+
+func Test_StoredMeta(t *testing.T) {
+	origin := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", `max-age=60, private="X-User", no-cache="X-Session"`)
+		w.Header().Set("X-User", "alice")
+		w.Header().Set("X-Session", "s1")
+		w.Write([]byte("doc"))
+	}
+	private := func(service *Service) {
+		d := gohttpcache.NewPrivateDeterminer()
+		service.Determiner = &d
+	}
+	for name, expected := range map[string]string{"public": "", "private": "alice"} {
+		var p *testproxy
+		if name == "public" {
+			p = newtestproxy(t, origin)
+		} else {
+			p = newtestproxy(t, origin, private)
+		}
+		if w := p.get("/doc"); w.Header().Get("X-User") != "alice" {
+			t.Error(name, "client that triggered the fetch should get every field, got", w.Header())
+		}
+		w := p.get("/doc")
+		if cachestatus(w) != "HIT" || w.Header().Get("X-User") != expected || w.Header().Get("X-Session") != "" {
+			t.Error(name, "should store the fields its Determiner allows, got", cachestatus(w), w.Header())
+		}
+	}
+}
+
+func Test_RequestDirectives(t *testing.T) {
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/stale" {
+			//Already 40 seconds past its freshness lifetime
+			w.Header().Set("Age", "100")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("doc"))
+	})
+	if w := p.get("/stale", "Cache-Control", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Error("only-if-cached should be a 504 when nothing is stored, got", w.Code)
+	}
+	p.get("/stale")
+	p.get("/fresh")
+	p.fetched()
+	for _, c := range []struct {
+		path, cachecontrol, status string
+		code                       int
+	}{
+		{"/stale", "max-stale=60", "HIT", http.StatusOK},
+		{"/stale", "max-stale", "HIT", http.StatusOK},
+		{"/stale", "only-if-cached", "", http.StatusGatewayTimeout},
+		{"/stale", "max-stale=10", "REVALIDATED", http.StatusOK},
+		{"/fresh", "min-fresh=30", "HIT", http.StatusOK},
+		{"/fresh", "min-fresh=120", "REVALIDATED", http.StatusOK},
+		{"/fresh", "only-if-cached, min-fresh=120", "", http.StatusGatewayTimeout},
+	} {
+		w := p.get(c.path, "Cache-Control", c.cachecontrol)
+		if w.Code != c.code || (c.status != "" && cachestatus(w) != c.status) {
+			t.Error(c.path, c.cachecontrol, "should be", c.code, c.status, "got", w.Code, cachestatus(w))
+		}
+		expected := 0
+		if c.status == "REVALIDATED" {
+			expected = 1
+		}
+		if n := p.fetched(); n != expected {
+			t.Error(c.path, c.cachecontrol, "should only go to origin to revalidate, got", n)
+		}
+	}
+}
+
+func Test_OriginDown(t *testing.T) {
+	origin := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("doc"))
+	}
+	for name, c := range map[string]struct {
+		method    string
+		slicesize int64
+		stored    bool
+	}{
+		"miss":       {"GET", 0, false},
+		"forward":    {"POST", 0, false},
+		"revalidate": {"GET", 0, true},
+		"slices":     {"GET", 16, false},
+	} {
+		p := newtestproxy(t, origin, withslices(c.slicesize))
+		if c.stored {
+			p.get("/doc")
+		}
+		p.origin.Close()
+		if w := p.do(c.method, "/doc", ""); w.Code != http.StatusBadGateway || readbody(w) != string(backenderr) {
+			t.Error(name, "should tell the client origin failed, got", w.Code, readbody(w))
+		}
+	}
+}
+
+func Test_FailAfterHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := newrequest(w, r)
+		req.stamp()
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("half"))
+		w.(http.Flusher).Flush()
+		req.fail(errors.New("origin went away"))
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err = io.ReadAll(resp.Body); err == nil {
+		t.Error("response should be cut short once its headers are out")
+	}
+}
+
+//Tells if it was used after being closed
+type closingstore struct {
+	Store
+	closed    int32
+	afterward int32
+}
+
+func (self *closingstore) Set(key []byte, size int, ttl time.Duration) (StoreTxn, error) {
+	if atomic.LoadInt32(&self.closed) == 1 {
+		atomic.StoreInt32(&self.afterward, 1)
+	}
+	return self.Store.Set(key, size, ttl)
+}
+
+func (self *closingstore) Close() error {
+	atomic.StoreInt32(&self.closed, 1)
+	return nil
+}
+
+func Test_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	p := newtestproxy(t, sloworigin(release, "max-age=60"))
+	objs := &closingstore{Store: p.objcache}
+	p.objcache = objs
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.ListenAndServe(addr, time.Minute)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+	}
+	body := make(chan string, 1)
+	go func() {
+		r, _ := http.NewRequest("GET", "http://"+addr+"/doc", nil)
+		r.Host = "example.com"
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	waitflights(t, p, 1)
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- p.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown should wait for the request in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if got := <-body; got != "first half second half" {
+		t.Error("request in progress should complete, got", got)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Error("ListenAndServe should return once shut down, got", err)
+	}
+	if atomic.LoadInt32(&objs.closed) != 1 || atomic.LoadInt32(&objs.afterward) != 0 {
+		t.Error("stores should be closed once done with")
+	}
+}
@@ -0,0 +1,481 @@
+package goproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Remembers which primary keys (metakeys) were stored for each URL and each
+//surrogate key, so purges can find them. Stores cannot list their keys.
+//Entries go away when purged, once everything stored under them expired, or
+//when a lookup finds them evicted. Saved in metacache as it changes and on
+//Close, for the next run to pick up.
+type purgeindex struct {
+	mu      sync.Mutex
+	entries map[string]*indexentry                //By metakey
+	urls    map[string]map[string]map[string]bool //Service Id -> RequestURI -> metakeys
+	tags    map[string]map[string]map[string]bool //Service Id -> surrogate key -> metakeys
+	swept   time.Time                             //When expired entries were last dropped
+	changed bool                                  //Since it was last saved
+}
+
+//What the index knows about a metakey
+type indexentry struct {
+	id      string
+	uri     string
+	tags    []string
+	expires time.Time //When the last variant stored under it expires
+}
+
+//How often the index is swept for expired entries
+const sweepinterval = time.Minute
+
+//How often the index is saved if it changed, so a crash loses at most this
+//much of it. A var so tests need not wait that long.
+var indexsaveinterval = 10 * time.Second
+
+//The index is kept in metacache under this key between runs. Encoded as
+//version 1, a uint count and for each entry the metakey, service id and URI
+//as bytes, a uint count of surrogate keys each as bytes, then the expires
+//time, see metacodec.go.
+var indexkey = []byte("\x00purgeindex")
+
+const indexversion = 1
+
+func newpurgeindex() *purgeindex {
+	return &purgeindex{
+		entries: make(map[string]*indexentry),
+		urls:    make(map[string]map[string]map[string]bool),
+		tags:    make(map[string]map[string]map[string]bool),
+	}
+}
+
+func addindex(index map[string]map[string]map[string]bool, id, name, metakey string) {
+	if index[id] == nil {
+		index[id] = make(map[string]map[string]bool)
+	}
+	if index[id][name] == nil {
+		index[id][name] = make(map[string]bool)
+	}
+	index[id][name][metakey] = true
+}
+
+func removeindex(index map[string]map[string]map[string]bool, id, name, metakey string) {
+	delete(index[id][name], metakey)
+	if len(index[id][name]) == 0 {
+		delete(index[id], name)
+	}
+	if len(index[id]) == 0 {
+		delete(index, id)
+	}
+}
+
+//Record a variant stored under metakey for ttl
+func (self *purgeindex) add(id, uri string, tags []string, metakey []byte, ttl time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	now := time.Now()
+	self.insert(string(metakey), &indexentry{id: id, uri: uri, tags: tags, expires: now.Add(ttl)})
+	self.sweep(now)
+}
+
+//Must hold the lock. Other variants may live longer, or be tagged differently.
+func (self *purgeindex) insert(metakey string, e *indexentry) {
+	if old, ok := self.entries[metakey]; ok {
+		if old.expires.After(e.expires) {
+			e.expires = old.expires
+		}
+		if old.id == e.id {
+			e.tags = dedupe(append(append([]string(nil), old.tags...), e.tags...))
+		}
+		self.forget(metakey)
+	}
+	self.entries[metakey] = e
+	self.changed = true
+	addindex(self.urls, e.id, e.uri, metakey)
+	for _, tag := range e.tags {
+		addindex(self.tags, e.id, tag, metakey)
+	}
+}
+
+//Must hold the lock
+func (self *purgeindex) forget(metakey string) {
+	e, ok := self.entries[metakey]
+	if !ok {
+		return
+	}
+	delete(self.entries, metakey)
+	self.changed = true
+	removeindex(self.urls, e.id, e.uri, metakey)
+	for _, tag := range e.tags {
+		removeindex(self.tags, e.id, tag, metakey)
+	}
+}
+
+//Drop entries for what expired, at most once per sweepinterval. Must hold
+//the lock.
+func (self *purgeindex) sweep(now time.Time) {
+	if now.Sub(self.swept) < sweepinterval {
+		return
+	}
+	self.swept = now
+	for k, e := range self.entries {
+		if !now.Before(e.expires) {
+			self.forget(k)
+		}
+	}
+}
+
+//Metakeys for URLs matching a prefix or wildcard pattern
+func (self *purgeindex) matchurls(id, pattern string) (metakeys []string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sweep(time.Now())
+	for uri, keys := range self.urls[id] {
+		if matchpattern(pattern, uri) {
+			for k := range keys {
+				metakeys = append(metakeys, k)
+			}
+		}
+	}
+	return
+}
+
+func (self *purgeindex) urlkeys(id, uri string) (metakeys []string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sweep(time.Now())
+	for k := range self.urls[id][uri] {
+		metakeys = append(metakeys, k)
+	}
+	return
+}
+
+func (self *purgeindex) tagkeys(id, tag string) (metakeys []string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sweep(time.Now())
+	for k := range self.tags[id][tag] {
+		metakeys = append(metakeys, k)
+	}
+	return
+}
+
+//Forget metakeys that were purged, or found evicted
+func (self *purgeindex) remove(metakeys ...string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, k := range metakeys {
+		self.forget(k)
+	}
+}
+
+func (self *purgeindex) len() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.entries)
+}
+
+//Keep the index in store until the last entry expires
+func (self *purgeindex) save(store Store) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.swept = time.Time{}
+	self.sweep(time.Now())
+	var last time.Time
+	w := &metawriter{buf: []byte{indexversion}}
+	w.uint(uint64(len(self.entries)))
+	for k, e := range self.entries {
+		w.string(k)
+		w.string(e.id)
+		w.string(e.uri)
+		w.uint(uint64(len(e.tags)))
+		for _, tag := range e.tags {
+			w.string(tag)
+		}
+		w.time(e.expires)
+		if e.expires.After(last) {
+			last = e.expires
+		}
+	}
+	self.changed = false
+	if len(self.entries) == 0 {
+		store.Delete(indexkey)
+		return nil
+	}
+	return setvalue(store, indexkey, w.buf, time.Until(last))
+}
+
+//Save the index every interval if it changed, until stop is closed
+func (self *purgeindex) autosave(store Store, interval time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.mu.Lock()
+			changed := self.changed
+			self.mu.Unlock()
+			if !changed {
+				continue
+			}
+			if err := self.save(store); err != nil {
+				log.Println("saving purge index", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+//Pick up the index saved by an earlier run
+func (self *purgeindex) load(store Store) {
+	m, err := getvalue(store, indexkey)
+	if err != nil {
+		if err != ErrNotFound {
+			log.Println("loading purge index", err)
+		}
+		return
+	}
+	r := &metareader{buf: m}
+	r.version(indexversion)
+	n := r.count()
+	entries := make(map[string]*indexentry, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		k := r.string()
+		e := &indexentry{id: r.string(), uri: r.string()}
+		e.tags = make([]string, r.count())
+		for j := range e.tags {
+			e.tags[j] = r.string()
+		}
+		e.expires = r.time()
+		entries[k] = e
+	}
+	if err = r.end(); err != nil {
+		log.Println("loading purge index", err)
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	now := time.Now()
+	for k, e := range entries {
+		if now.Before(e.expires) {
+			self.insert(k, e)
+		}
+	}
+}
+
+//A pattern without "*" is a prefix. Otherwise "*" matches any run of
+//characters, "/" included, and the pattern must match the whole URL.
+func matchpattern(pattern, uri string) bool {
+	if !strings.Contains(pattern, "*") {
+		return strings.HasPrefix(uri, pattern)
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(uri, parts[0]) {
+		return false
+	}
+	uri = uri[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(uri, part)
+		if idx < 0 {
+			return false
+		}
+		uri = uri[idx+len(part):]
+	}
+	return strings.HasSuffix(uri, last)
+}
+
+//Surrogate keys a response is tagged with, from Surrogate-Key (space
+//separated) and Cache-Tag (comma separated)
+func surrogatekeys(hdr http.Header) (tags []string) {
+	for _, v := range hdr[http.CanonicalHeaderKey("Surrogate-Key")] {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	for _, v := range hdr[http.CanonicalHeaderKey("Cache-Tag")] {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return
+}
+
+//Purge every variant stored under metakey. A soft purge only marks them
+//stale, so they are revalidated (or served stale where allowed) instead of
+//fetched again. Returns how many objects were purged.
+func (self *ProxyServer) purgemeta(metakey []byte, soft bool) (n int) {
+	defer self.lockvariants(metakey).Unlock()
+	v, err := self.getvariants(metakey)
+	keys := v.Keys
+	if err != nil {
+		//Stored before we tracked variants, or never varied
+		keys = [][]byte{metakey}
+	}
+	for _, key := range keys {
+		if self.purgeobject(key, soft) {
+			n++
+		}
+	}
+	if !soft {
+		self.metacache.Delete(metakey)
+	}
+	return
+}
+
+func (self *ProxyServer) purgeobject(objkey []byte, soft bool) bool {
+	if !soft {
+		if sliced, err := self.loadsliced(objkey); err == nil {
+			self.deleteslices(objkey, sliced)
+		}
+		deleted := self.objcache.Delete(objkey)
+		self.metacache.Delete(refreshedkey(objkey))
+		return self.metacache.Delete(slicedkey(objkey)) || deleted
+	}
+	if sliced, err := self.loadsliced(objkey); err == nil {
+		sliced.Meta.Lifetime = 0
+		self.storesliced(objkey, sliced)
+		return true
+	}
+	item, err := self.objcache.Get(objkey)
+	if err != nil {
+		return false
+	}
+	meta, _, err := self.loadentry(objkey, item)
+	item.Close()
+	if err != nil {
+		return false
+	}
+	meta = self.loadrefreshed(objkey, meta)
+	meta.Lifetime = 0
+	self.storerefreshed(objkey, meta)
+	return true
+}
+
+func (self *ProxyServer) purgemetas(service *Service, metakeys []string, soft bool) (n int) {
+	for _, k := range metakeys {
+		n += self.purgemeta([]byte(k), soft)
+	}
+	if !soft {
+		self.index.remove(metakeys...)
+	}
+	return
+}
+
+//PurgeURL purges all variants of a URL on a configured hostname, uri being
+//the path and query. Returns how many objects were purged.
+func (self *ProxyServer) PurgeURL(host, uri string, soft bool) int {
+	service, ok := self.configs[host]
+	if !ok {
+		return 0
+	}
+	metakeys := self.index.urlkeys(service.Id, uri)
+	//Also whatever the key function makes of it, in case it was stored
+	//before we indexed it
+	for _, method := range []string{"GET", "HEAD"} {
+		r, err := http.NewRequest(method, "http://"+host+uri, nil)
+		if err != nil {
+			return 0
+		}
+		r.RequestURI = uri
+		basekey := service.getbasekey(r)
+		metakeys = append(metakeys, string(basekey), string(basekey)+"\x00authorized")
+	}
+	return self.purgemetas(service, dedupe(metakeys), soft)
+}
+
+//PurgePrefix purges every stored URL on a configured hostname matching a
+//prefix, or a pattern with "*" wildcards.
+func (self *ProxyServer) PurgePrefix(host, pattern string, soft bool) int {
+	service, ok := self.configs[host]
+	if !ok {
+		return 0
+	}
+	return self.purgemetas(service, self.index.matchurls(service.Id, pattern), soft)
+}
+
+//PurgeKey purges every object tagged with a surrogate key, by Surrogate-Key
+//or Cache-Tag, on a configured hostname.
+func (self *ProxyServer) PurgeKey(host, key string, soft bool) int {
+	service, ok := self.configs[host]
+	if !ok {
+		return 0
+	}
+	return self.purgemetas(service, self.index.tagkeys(service.Id, key), soft)
+}
+
+func dedupe(keys []string) (out []string) {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	return
+}
+
+//AdminHandler serves the purge and ban API, for requests bearing the token as
+//"Authorization: Bearer <token>". Serve it on an address clients cannot
+//reach.
+//
+//	POST /purge  host=<hostname> and one of url=<path?query>, prefix=<pattern>
+//	             or key=<surrogate key>, soft=1 to only mark stale
+//	POST /ban    any of host=<hostname>, path=<regexp>, header=<name> with
+//	             value=<regexp>, see Ban
+func (self *ProxyServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		host := r.FormValue("host")
+		soft := r.FormValue("soft") == "1"
+		var n int
+		switch {
+		case r.FormValue("url") != "":
+			n = self.PurgeURL(host, r.FormValue("url"), soft)
+		case r.FormValue("prefix") != "":
+			n = self.PurgePrefix(host, r.FormValue("prefix"), soft)
+		case r.FormValue("key") != "":
+			n = self.PurgeKey(host, r.FormValue("key"), soft)
+		default:
+			http.Error(w, "One of url, prefix or key is required.", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": n})
+	})
+	mux.HandleFunc("/ban", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		err := self.Ban(r.FormValue("host"), r.FormValue("path"), r.FormValue("header"), r.FormValue("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"bans": self.bans.len()})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + token)
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
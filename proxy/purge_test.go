@@ -0,0 +1,189 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func purgeorigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", `"v1"`)
+	if r.URL.Path != "/b" {
+		w.Header().Set("Surrogate-Key", "a "+r.URL.Path)
+	}
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(r.URL.Path))
+}
+
+func Test_Purge(t *testing.T) {
+	p := newtestproxy(t, purgeorigin)
+	paths := []string{"/a/1", "/a/2", "/b"}
+	expect := func(name string, statuses ...string) {
+		for i, path := range paths {
+			if w := p.get(path); cachestatus(w) != statuses[i] || readbody(w) != path {
+				t.Error(name, path, "should be", statuses[i], "got", cachestatus(w), readbody(w))
+			}
+		}
+	}
+	expect("first fetch", "MISS", "MISS", "MISS")
+	if n := p.PurgeURL("example.com", "/a/1", false); n != 1 {
+		t.Error("url purge should purge one object, got", n)
+	}
+	expect("after url purge", "MISS", "HIT", "HIT")
+	if n := p.PurgeURL("example.com", "/a/2", true); n != 1 {
+		t.Error("soft purge should purge one object, got", n)
+	}
+	expect("after soft purge", "HIT", "REVALIDATED", "HIT")
+	if n := p.PurgePrefix("example.com", "/a/", false); n != 2 {
+		t.Error("prefix purge should purge two objects, got", n)
+	}
+	expect("after prefix purge", "MISS", "MISS", "HIT")
+	if n := p.PurgeKey("example.com", "a", false); n != 2 {
+		t.Error("key purge should purge two objects, got", n)
+	}
+	expect("after key purge", "MISS", "MISS", "HIT")
+	if n := p.PurgeKey("example.com", "/a/2", false); n != 1 {
+		t.Error("key purge should purge one object, got", n)
+	}
+	expect("after second key purge", "HIT", "MISS", "HIT")
+	if n := p.PurgeURL("other.com", "/b", false); n != 0 {
+		t.Error("unknown host should purge nothing, got", n)
+	}
+}
+
+func Test_PurgeSlices(t *testing.T) {
+	p := newtestproxy(t, servecontent, withslices(16))
+	p.get("/doc")
+	stored := func() (n int) {
+		for idx := int64(0); idx < 7; idx++ {
+			if _, err := getvalue(p.objcache, slicekey([]byte("GETt/doc"), `"v1"`, 16, idx)); err == nil {
+				n++
+			}
+		}
+		return
+	}
+	if n := stored(); n != 7 {
+		t.Fatal("all slices should be stored, found", n)
+	}
+	if n := p.PurgeURL("example.com", "/doc", false); n != 1 {
+		t.Error("sliced object should be purged, got", n)
+	}
+	if n := stored(); n != 0 {
+		t.Error("purge should remove the slices, found", n)
+	}
+}
+
+func Test_PurgeIndex(t *testing.T) {
+	index := newpurgeindex()
+	index.add("t", "/old", []string{"tag"}, []byte("GETt/old"), -time.Second)
+	index.add("t", "/new", []string{"tag"}, []byte("GETt/new"), time.Hour)
+	//Another variant with a longer life and more tags
+	index.add("t", "/new", []string{"other"}, []byte("GETt/new"), 2*time.Hour)
+	index.swept = time.Time{}
+	if keys := index.tagkeys("t", "tag"); len(keys) != 1 || keys[0] != "GETt/new" || index.len() != 1 {
+		t.Error("expired entries should be swept, got", keys, index.len())
+	}
+	if keys := index.tagkeys("t", "other"); len(keys) != 1 {
+		t.Error("tags of every variant should be kept, got", keys)
+	}
+	index.remove("GETt/new")
+	if index.len() != 0 || len(index.urls) != 0 || len(index.tags) != 0 {
+		t.Error("removed entries should leave nothing behind", index.urls, index.tags)
+	}
+
+	//Evicted entries are dropped when looked up, the rest survive a restart
+	p := newtestproxy(t, purgeorigin)
+	p.get("/a/1")
+	p.get("/a/2")
+	p.metacache.Delete([]byte("GETt/a/1"))
+	p.get("/a/1")
+	if p.index.len() != 1 {
+		t.Error("evicted entry should be dropped, got", p.index.len())
+	}
+	p.Close()
+	restarted := NewProxyServerWithStores([]Service{*p.configs["example.com"]}, p.objcache, p.metacache, t.TempDir())
+	if n := restarted.PurgeKey("example.com", "/a/2", false); n != 1 {
+		t.Error("index should survive a restart, purged", n)
+	}
+}
+
+func Test_PurgeIndexSaved(t *testing.T) {
+	defer func(interval time.Duration) { indexsaveinterval = interval }(indexsaveinterval)
+	indexsaveinterval = 10 * time.Millisecond
+	p := newtestproxy(t, purgeorigin)
+	p.get("/a/1")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := getvalue(p.metacache, indexkey); err == nil {
+			break
+		}
+	}
+	//Crashed, never closed
+	restarted := NewProxyServerWithStores([]Service{*p.configs["example.com"]}, p.objcache, p.metacache, t.TempDir())
+	if n := restarted.PurgeKey("example.com", "/a/1", false); n != 1 {
+		t.Error("index should be saved without a Close, purged", n)
+	}
+}
+
+func adminrequest(admin http.Handler, method, path, form, auth string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", auth)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	return w
+}
+
+func Test_AdminHandler(t *testing.T) {
+	p := newtestproxy(t, purgeorigin)
+	admin := p.AdminHandler("secret")
+	post := func(path, form string) *httptest.ResponseRecorder {
+		return adminrequest(admin, "POST", path, form, "Bearer secret")
+	}
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		if w := adminrequest(admin, "POST", "/purge", "host=example.com&url=/a/1", auth); w.Code != http.StatusUnauthorized {
+			t.Error(auth, "should be refused, got", w.Code)
+		}
+	}
+	if w := adminrequest(p.AdminHandler(""), "POST", "/ban", "", "Bearer "); w.Code != http.StatusUnauthorized {
+		t.Error("admin without a token should refuse everything, got", w.Code)
+	}
+	if w := adminrequest(admin, "GET", "/purge", "", "Bearer secret"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Error("purge should only take POST, got", w.Code)
+	}
+	if w := post("/purge", "host=example.com"); w.Code != http.StatusBadRequest {
+		t.Error("purge without url, prefix or key should be refused, got", w.Code)
+	}
+
+	for _, path := range []string{"/a/1", "/a/2", "/b"} {
+		p.get(path)
+	}
+	for _, c := range []struct{ form, expected string }{
+		{"host=example.com&url=/a/1", `{"purged":1}`},
+		{"host=example.com&prefix=/a/", `{"purged":1}`},
+		{"host=example.com&key=a&soft=1", `{"purged":0}`},
+		{"host=example.com&url=/b&soft=1", `{"purged":1}`},
+	} {
+		if w := post("/purge", c.form); w.Code != http.StatusOK || strings.TrimSpace(readbody(w)) != c.expected {
+			t.Error(c.form, "should answer", c.expected, "got", w.Code, readbody(w))
+		}
+	}
+	if w := p.get("/b"); cachestatus(w) != "REVALIDATED" {
+		t.Error("soft purge should only mark stale, got", cachestatus(w))
+	}
+
+	if w := post("/ban", "path=("); w.Code != http.StatusBadRequest {
+		t.Error("invalid ban should be refused, got", w.Code)
+	}
+	if w := post("/ban", "host=example.com&path=^/b"); w.Code != http.StatusOK || strings.TrimSpace(readbody(w)) != `{"bans":1}` {
+		t.Error("ban should be added, got", w.Code, readbody(w))
+	}
+	if w := p.get("/b"); cachestatus(w) != "MISS" {
+		t.Error("banned object should be fetched again, got", cachestatus(w))
+	}
+}
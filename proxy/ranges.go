@@ -0,0 +1,246 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sajal/gohttpcache/cache"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errbackwardseek = errors.New("cannot seek backwards in stream")
+
+//A satisfiable byte range within a representation
+type byterange struct {
+	start  int64
+	length int64
+}
+
+func (self byterange) contentrange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", self.start, self.start+self.length-1, size)
+}
+
+//Range headers asking for more ranges than this are ignored, a long list of
+//overlapping ranges makes for a response many times the size of the body
+const maxranges = 100
+
+//parseranges parses a Range header against a representation of size bytes,
+//rfc7233 section 2.1. ok is false if the header is not a valid bytes range
+//set, or asks for too many ranges, and must be ignored. Unsatisfiable ranges
+//are dropped, so ok with no ranges means 416. The ranges returned are in
+//ascending order, with overlapping and adjacent ones merged as allowed by
+//section 4.1.
+func parseranges(header string, size int64) (ranges []byterange, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return
+	}
+	specs := 0
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+		if specs > maxranges {
+			return nil, false
+		}
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, false
+		}
+		first, last := spec[:dash], spec[dash+1:]
+		var r byterange
+		if first == "" {
+			//suffix-byte-range-spec, the last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byterange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, false
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, false
+				}
+				if end > size-1 {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byterange{start, end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	return coalesce(ranges), specs > 0
+}
+
+//Sort ranges and merge those that overlap or are adjacent
+func coalesce(ranges []byterange) []byterange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].start+merged[n-1].length {
+			last := &merged[n-1]
+			if end := r.start + r.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+//ifrange checks the If-Range precondition of rfc7233 section 3.2. The
+//range is only honored if the validator matches what we have.
+func ifrange(reqhdrs, reshdrs http.Header) bool {
+	value := reqhdrs.Get("If-Range")
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return gohttpcache.MatchETag(value, reshdrs.Get("ETag"), false)
+	}
+	lastmodified := reshdrs.Get("Last-Modified")
+	return lastmodified != "" && value == lastmodified
+}
+
+//bodysize finds the size of a body, by seeking if possible, else from
+//Content-Length. -1 if unknown.
+func bodysize(meta MetaItem, body io.Reader) int64 {
+	if seeker, ok := body.(io.Seeker); ok {
+		cur, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err == nil {
+				_, err = seeker.Seek(cur, io.SeekStart)
+				if err == nil {
+					return end - cur
+				}
+			}
+		}
+	}
+	size, err := strconv.ParseInt(meta.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+//Reads byte ranges out of a body, seeking when the body allows it and
+//skipping forward otherwise.
+type rangereader struct {
+	body io.Reader
+	base int64 //Offset of the body within a seekable item
+	pos  int64 //Current position within the body
+}
+
+func newrangereader(body io.Reader) *rangereader {
+	rr := &rangereader{body: body}
+	if seeker, ok := body.(io.Seeker); ok {
+		rr.base, _ = seeker.Seek(0, io.SeekCurrent)
+	}
+	return rr
+}
+
+func (self *rangereader) copyrange(w io.Writer, r byterange) (err error) {
+	if seeker, ok := self.body.(io.Seeker); ok {
+		_, err = seeker.Seek(self.base+r.start, io.SeekStart)
+	} else if r.start < self.pos {
+		err = errbackwardseek
+	} else {
+		_, err = io.CopyN(ioutil.Discard, self.body, r.start-self.pos)
+	}
+	if err != nil {
+		return
+	}
+	_, err = io.CopyN(w, self.body, r.length)
+	self.pos = r.start + r.length
+	return
+}
+
+//serveranges answers a Range request from a complete stored (or streaming)
+//response with 206 or 416. Returns false if the Range header has to be
+//ignored, in which case the full response should be sent instead.
+//Response headers from meta are expected to be already set.
+func (self *transaction) serveranges(meta MetaItem, body io.Reader) bool {
+	if self.clientreq.Method != "GET" || meta.Status != http.StatusOK {
+		return false
+	}
+	header := self.clientreq.Header.Get("Range")
+	if header == "" || !ifrange(self.clientreq.Header, meta.Header) {
+		return false
+	}
+	size := bodysize(meta, body)
+	if size < 0 {
+		return false
+	}
+	ranges, ok := parseranges(header, size)
+	if !ok {
+		return false
+	}
+	hdr := self.respwriter.Header()
+	if len(ranges) == 0 {
+		hdr.Del("Content-Length")
+		hdr.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		self.stamp()
+		self.respwriter.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	//Ranges are in ascending order, so a streaming body only has to go forward
+	rr := newrangereader(body)
+	if len(ranges) == 1 {
+		hdr.Set("Content-Range", ranges[0].contentrange(size))
+		hdr.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		self.stamp()
+		self.respwriter.WriteHeader(http.StatusPartialContent)
+		err := rr.copyrange(self.respwriter, ranges[0])
+		if err != nil {
+			self.log("serveranges", err)
+		}
+		return true
+	}
+	mw := multipart.NewWriter(self.respwriter)
+	contenttype := hdr.Get("Content-Type")
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	self.stamp()
+	self.respwriter.WriteHeader(http.StatusPartialContent)
+	for _, r := range ranges {
+		parthdr := make(textproto.MIMEHeader)
+		if contenttype != "" {
+			parthdr.Set("Content-Type", contenttype)
+		}
+		parthdr.Set("Content-Range", r.contentrange(size))
+		part, err := mw.CreatePart(parthdr)
+		if err == nil {
+			err = rr.copyrange(part, r)
+		}
+		if err != nil {
+			self.log("serveranges", err)
+			return true
+		}
+	}
+	mw.Close()
+	return true
+}
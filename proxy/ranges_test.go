@@ -0,0 +1,68 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type rangetest struct {
+	Header string
+	Size   int64
+	Ok     bool
+	Ranges []byterange
+}
+
+var rangetests = []rangetest{
+	{"bytes=0-9", 100, true, []byterange{{0, 10}}},
+	{"bytes=90-", 100, true, []byterange{{90, 10}}},
+	{"bytes=-10", 100, true, []byterange{{90, 10}}},
+	{"bytes=-200", 100, true, []byterange{{0, 100}}},
+	{"bytes=50-200", 100, true, []byterange{{50, 50}}},
+	{"bytes=0-0,-1", 100, true, []byterange{{0, 1}, {99, 1}}},
+	//Out of order, overlapping and adjacent ranges are merged
+	{"bytes=50-59,0-9", 100, true, []byterange{{0, 10}, {50, 10}}},
+	{"bytes=0-9,5-19", 100, true, []byterange{{0, 20}}},
+	{"bytes=0-9,10-19", 100, true, []byterange{{0, 20}}},
+	{"bytes=0-,0-,0-", 100, true, []byterange{{0, 100}}},
+	{"bytes=10-19,0-4,5-9,-5", 100, true, []byterange{{0, 20}, {95, 5}}},
+	//Unsatisfiable
+	{"bytes=100-", 100, true, nil},
+	{"bytes=-0", 100, true, nil},
+	{"bytes=-1", 0, true, nil},
+	{"bytes=0-", 0, true, nil},
+	{"bytes=200-300,-0", 100, true, nil},
+	//Invalid, the header is ignored
+	{"items=0-9", 100, false, nil},
+	{"bytes=", 100, false, nil},
+	{"bytes=9-0", 100, false, nil},
+	{"bytes=a-b", 100, false, nil},
+	{"bytes=5", 100, false, nil},
+	{"bytes=" + strings.Repeat("0-,", maxranges) + "0-", 100, false, nil},
+}
+
+func Test_ParseRanges(t *testing.T) {
+	for _, c := range rangetests {
+		ranges, ok := parseranges(c.Header, c.Size)
+		if ok != c.Ok || fmt.Sprint(ranges) != fmt.Sprint(c.Ranges) {
+			t.Error(c.Header, c.Size, "expected", c.Ok, c.Ranges, "got", ok, ranges)
+		}
+	}
+}
+
+func Test_ServeRanges(t *testing.T) {
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat("0123456789", 100)))
+	})
+	p.get("/doc")
+	w := p.get("/doc", "Range", "bytes=10-19,15-24")
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != "bytes 10-24/1000" || readbody(w) != "012345678901234" {
+		t.Error("overlapping ranges should be served as one, got", w.Code, w.Header(), readbody(w))
+	}
+	w = p.get("/doc", "Range", "bytes="+strings.Repeat("0-,", 500)+"0-")
+	if w.Code != http.StatusOK || w.Body.Len() != 1000 {
+		t.Error("too many ranges should get the whole body, got", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,117 @@
+package goproxy
+
+import (
+	"github.com/sajal/gohttpcache/cache"
+	"io"
+	"net/http"
+	"time"
+)
+
+//Headers from a 304 that must not replace those of the stored response
+var notupdated = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+//Can we ask origin if a stored response is still valid?
+func hasvalidators(meta MetaItem) bool {
+	return meta.Header.Get("ETag") != "" || meta.Header.Get("Last-Modified") != ""
+}
+
+//Key in metacache for the refreshed metadata of an object
+func refreshedkey(objkey []byte) []byte {
+	return append(append([]byte(nil), objkey...), []byte("\x00refreshed")...)
+}
+
+//Revalidate a stored response with origin using a conditional request, rfc7234
+//section 4.3. On 304 only the metadata is refreshed, the stored body is reused.
+//Anything else replaces the stored response, unless origin failed and
+//stale-if-error lets us serve what we have. Responses without validators
+//get here only for stale-if-error, the request is then unconditional.
+func (self *ProxyServer) revalidate(req *transaction, service *Service, meta MetaItem, item io.ReadCloser) {
+	fetchstart := time.Now()
+	originreq, err := originrequest(req, service)
+	if err != nil {
+		item.Close()
+		req.fail(err)
+		return
+	}
+	if etag := meta.Header.Get("ETag"); etag != "" {
+		originreq.Header.Set("If-None-Match", etag)
+	}
+	if lastmodified := meta.Header.Get("Last-Modified"); lastmodified != "" {
+		originreq.Header.Set("If-Modified-Since", lastmodified)
+	}
+	resp, err := service.client.RoundTrip(originreq)
+	if err != nil {
+		if req.servableonerror(meta) {
+			req.log("origin unreachable, serving stale:", err)
+			req.servestale(meta, item, gohttpcache.RevalidationFailedWarning)
+			return
+		}
+		item.Close()
+		req.fail(err)
+		return
+	}
+	defer resp.Body.Close()
+	req.origintime = time.Since(fetchstart)
+	if resp.StatusCode >= 500 && req.servableonerror(meta) {
+		req.log("origin returned", resp.StatusCode, "serving stale")
+		req.servestale(meta, item, gohttpcache.RevalidationFailedWarning)
+		return
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		req.log("revalidation got", resp.StatusCode)
+		item.Close()
+		_, err = self.storeresponse(req, service, resp, fetchstart)
+		if err != nil {
+			req.fail(err)
+		}
+		return
+	}
+	meta, decision := service.freshen(req, meta, resp, fetchstart)
+	if req.unstorable(meta.Status, decision) == "" {
+		self.storerefreshed(req.objkey, storedmeta(meta, decision))
+	}
+	req.hit = true
+	req.revalidated = true
+	req.servebody(meta, item)
+}
+
+//Freshen a stored response with the headers of a 304, rfc7234 section 4.3.4.
+//The decision tells if the updated response may still be stored.
+func (self *Service) freshen(req *transaction, meta MetaItem, resp *http.Response, fetchstart time.Time) (freshened MetaItem, decision gohttpcache.Decision) {
+	meta.Header = meta.Header.Clone()
+	for k, v := range resp.Header {
+		if !notupdated[k] {
+			meta.Header[k] = v
+		}
+	}
+	meta.Requested = fetchstart
+	meta.Fetched = time.Now()
+	decision = self.decide(req, meta.Status, meta.Header)
+	meta.apply(decision)
+	return meta, decision
+}
+
+//Store refreshed metadata for an object, kept as long as the object itself.
+//A 304 may carry fields meant for one client only, strip them first with
+//storedmeta.
+func (self *ProxyServer) storerefreshed(objkey []byte, meta MetaItem) {
+	setvalue(self.metacache, refreshedkey(objkey), encodemeta(meta), meta.Lifetime+staleretention)
+}
+
+//Use refreshed metadata for an object unless it is older than what was
+//stored along with the body. Soft purges refresh it without a new fetch.
+func (self *ProxyServer) loadrefreshed(objkey []byte, meta MetaItem) MetaItem {
+	m, err := getvalue(self.metacache, refreshedkey(objkey))
+	if err != nil {
+		return meta
+	}
+	refreshed, err := decodemeta(m)
+	if err != nil || refreshed.Fetched.Before(meta.Fetched) {
+		return meta
+	}
+	return refreshed
+}
@@ -0,0 +1,49 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_Revalidate(t *testing.T) {
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("Cache-Control", `max-age=60, private="X-Secret"`)
+			w.Header().Set("Set-Cookie", "session=first")
+			w.Header().Set("X-Secret", "first")
+			w.Header().Set("X-Refreshed", "yes")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("body"))
+	})
+	p.get("/doc")
+	w := p.get("/doc")
+	if cachestatus(w) != "REVALIDATED" || readbody(w) != "body" {
+		t.Fatal("stale response should be revalidated, got", cachestatus(w), readbody(w))
+	}
+	if w.Header().Get("Set-Cookie") != "session=first" || w.Header().Get("X-Secret") != "first" {
+		t.Error("client that revalidated should get the whole 304, got", w.Header())
+	}
+	if p.fetched() != 2 {
+		t.Error("origin should be asked once per request so far")
+	}
+
+	w = p.get("/doc")
+	if cachestatus(w) != "HIT" || readbody(w) != "body" {
+		t.Error("refreshed response should be fresh, got", cachestatus(w), readbody(w))
+	}
+	if w.Header().Get("X-Refreshed") != "yes" || w.Header().Get("Etag") != `"v1"` {
+		t.Error("304 headers should update the stored ones, got", w.Header())
+	}
+	for _, h := range []string{"Set-Cookie", "X-Secret"} {
+		if w.Header().Get(h) != "" {
+			t.Error(h, "from a 304 should not be served to another client")
+		}
+	}
+	if p.fetched() != 0 {
+		t.Error("fresh response should not go to origin")
+	}
+}
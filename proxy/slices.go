@@ -0,0 +1,367 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sajal/gohttpcache/cache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errslicechanged = errors.New("object changed at origin while fetching slices")
+	errslicerange   = errors.New("origin returned a different range than the slice asked for")
+)
+
+//Objects of services with a SliceSize are stored as a sliceditem in
+//metacache describing the whole object, plus one objcache entry per slice
+//holding just its bytes. Slices are fetched from origin with range requests
+//as clients need them, so no object is ever buffered as a whole.
+type sliceditem struct {
+	Meta      MetaItem //Headers of the whole object, as if it was a 200
+	Size      int64
+	Version   string //Identifies the representation the slices belong to
+	SliceSize int64  //Of the stored slices, the SliceSize when it was fetched
+}
+
+//Only plain GETs whose responses we may store are sliced
+func (self *transaction) sliceable() bool {
+	return self.clientreq.Method == "GET" && !self.policy.NoStore && !isauthorized(self.clientreq)
+}
+
+func slicedkey(objkey []byte) []byte {
+	return append(append([]byte(nil), objkey...), []byte("\x00sliced")...)
+}
+
+//Slices are keyed by their size too, so slices stored with another
+//SliceSize, say before a restart, are never mixed up with these
+func slicekey(objkey []byte, version string, slicesize, idx int64) []byte {
+	return append(append([]byte(nil), objkey...), []byte("\x00slice\x00"+version+"\x00"+strconv.FormatInt(slicesize, 10)+"\x00"+strconv.FormatInt(idx, 10))...)
+}
+
+//How many bytes slice idx holds, the last one may be short
+func (self sliceditem) slicelength(idx int64) int64 {
+	length := self.Size - idx*self.SliceSize
+	if length > self.SliceSize {
+		length = self.SliceSize
+	}
+	if length < 0 {
+		length = 0
+	}
+	return length
+}
+
+//Slices live as long as the object they belong to, and are only fetched
+//again if they expire first
+func (self sliceditem) slicettl() time.Duration {
+	return self.Meta.Lifetime + staleretention
+}
+
+//Remove every slice of an object, whether stored or not
+func (self *ProxyServer) deleteslices(objkey []byte, sliced sliceditem) {
+	for idx := int64(0); idx*sliced.SliceSize < sliced.Size; idx++ {
+		self.objcache.Delete(slicekey(objkey, sliced.Version, sliced.SliceSize, idx))
+	}
+}
+
+//Serve a GET from a sliced object we have and the client accepts. Otherwise
+//err tells if the object is stored at all.
+func (self *ProxyServer) servecachedslices(req *transaction, service *Service) (sliced sliceditem, served bool, err error) {
+	sliced, err = self.loadsliced(req.objkey)
+	if err == nil && self.checkbans(req, sliced.Meta) {
+		err = ErrNotFound
+	}
+	if err == nil && req.policy.Acceptable(sliced.Meta.Lifetime, sliced.Meta.age(time.Now()), sliced.Meta.MustRevalidate) {
+		req.hit = true
+		req.servebody(sliced.Meta, self.newslicereader(req, service, sliced))
+		served = true
+	}
+	return
+}
+
+//Serve a GET from a sliced object, fetching the first slice from origin if
+//we know nothing about the object or it needs revalidation.
+func (self *ProxyServer) serveslices(req *transaction, service *Service) {
+	sliced, served, err := self.servecachedslices(req, service)
+	if served {
+		return
+	}
+	fetchstart := time.Now()
+	var stored *MetaItem
+	if err == nil {
+		stored = &sliced.Meta
+	}
+	resp, err := fetchslice(req, service, 0, service.SliceSize, stored, true)
+	if err != nil {
+		req.fail(err)
+		return
+	}
+	defer resp.Body.Close()
+	req.origintime = time.Since(fetchstart)
+	var decision gohttpcache.Decision
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		//Our slices are still good
+		sliced.Meta, decision = service.freshen(req, sliced.Meta, resp, fetchstart)
+		req.hit = true
+		req.revalidated = true
+		if req.unstorable(sliced.Meta.Status, decision) != "" {
+			req.servebody(sliced.Meta, self.newslicereader(req, service, sliced))
+			return
+		}
+	case http.StatusPartialContent:
+		sliced, err = newsliced(resp, fetchstart)
+		if err != nil {
+			req.fail(err)
+			return
+		}
+		sliced.SliceSize = service.SliceSize
+		decision = service.decide(req, sliced.Meta.Status, sliced.Meta.Header)
+		if reason := req.unstorable(sliced.Meta.Status, decision); reason != "" {
+			//Pass the whole object thru instead
+			req.log("not slicing:", reason)
+			resp.Body.Close()
+			_, _, _, err = self.fetchfromorigin(req, service)
+			if err != nil {
+				req.fail(err)
+			}
+			return
+		}
+		if decision.Warning != "" {
+			sliced.Meta.Header.Add("Warning", decision.Warning)
+		}
+		sliced.Meta.apply(decision)
+		first, err := readslice(resp, 0, sliced.slicelength(0))
+		if err != nil {
+			req.log("slice 0:", err)
+			req.fail(err)
+			return
+		}
+		//Vary decides where the object goes, slices included
+		req.objkey, err = self.storevariant(req, service, resp.Header, sliced.slicettl())
+		if err != nil {
+			req.fail(err)
+			return
+		}
+		setvalue(self.objcache, slicekey(req.objkey, sliced.Version, sliced.SliceSize, 0), first, sliced.slicettl())
+	default:
+		//Origin does not do ranges for this object, cache it whole
+		_, err = self.storeresponse(req, service, resp, fetchstart)
+		if err != nil {
+			req.fail(err)
+		}
+		return
+	}
+	client := sliced.Meta
+	sliced.Meta = storedmeta(sliced.Meta, decision)
+	self.storesliced(req.objkey, sliced)
+	req.servebody(client, self.newslicereader(req, service, sliced))
+}
+
+//Request a slice from origin. Slices of a stored object are asked for in the
+//coding it was stored in, whatever the client accepts, and with validate the
+//request is conditional on its validators.
+func fetchslice(req *transaction, service *Service, start, length int64, stored *MetaItem, validate bool) (resp *http.Response, err error) {
+	originreq, err := originrequest(req, service)
+	if err != nil {
+		return
+	}
+	originreq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	if stored == nil {
+		return service.client.RoundTrip(originreq)
+	}
+	originreq.Header.Set("Accept-Encoding", contentcoding(stored.Header))
+	if validate {
+		if etag := stored.Header.Get("ETag"); etag != "" {
+			originreq.Header.Set("If-None-Match", etag)
+		}
+		if lastmodified := stored.Header.Get("Last-Modified"); lastmodified != "" {
+			originreq.Header.Set("If-Modified-Since", lastmodified)
+		}
+	}
+	return service.client.RoundTrip(originreq)
+}
+
+//The coding of a payload, identity if it has none
+func contentcoding(hdr http.Header) string {
+	if coding := strings.ToLower(hdr.Get("Content-Encoding")); coding != "" {
+		return coding
+	}
+	return "identity"
+}
+
+//Read the body of a 206 response to a slice request, which must be the
+//length bytes at start the slice asked for
+func readslice(resp *http.Response, start, length int64) (data []byte, err error) {
+	first, _, err := parsecontentrange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return
+	}
+	if first != start {
+		err = errslicerange
+		return
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, length))
+	if err == nil && int64(len(data)) != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+//Parse the Content-Range of a 206, bytes first-last/size
+func parsecontentrange(contentrange string) (first, size int64, err error) {
+	badrange := errors.New("bad Content-Range " + contentrange)
+	slash := strings.LastIndexByte(contentrange, '/')
+	dash := strings.IndexByte(contentrange, '-')
+	if !strings.HasPrefix(contentrange, "bytes ") || slash < 0 || dash < 0 || dash > slash {
+		err = badrange
+		return
+	}
+	first, err = strconv.ParseInt(contentrange[len("bytes "):dash], 10, 64)
+	if err == nil {
+		size, err = strconv.ParseInt(contentrange[slash+1:], 10, 64)
+	}
+	if err != nil || first < 0 || size < 0 {
+		err = badrange
+	}
+	return
+}
+
+//Describe the whole object from the 206 response to a slice request
+func newsliced(resp *http.Response, fetchstart time.Time) (sliced sliceditem, err error) {
+	_, sliced.Size, err = parsecontentrange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return
+	}
+	meta := MetaItem{Header: resp.Header.Clone(), Status: http.StatusOK, Fetched: time.Now(), Requested: fetchstart}
+	meta.Header.Del("Content-Range")
+	meta.Header.Set("Content-Length", strconv.FormatInt(sliced.Size, 10))
+	sliced.Meta = meta
+	sliced.Version = sliceversion(resp.Header)
+	if sliced.Version == "" {
+		//No validators, slices are only good for this fetch
+		sliced.Version = strconv.FormatInt(meta.Fetched.UnixNano(), 36)
+	}
+	return
+}
+
+//The validator identifying a representation, if any
+func sliceversion(hdr http.Header) string {
+	if etag := hdr.Get("ETag"); etag != "" {
+		return etag
+	}
+	return hdr.Get("Last-Modified")
+}
+
+func (self *ProxyServer) loadsliced(objkey []byte) (sliced sliceditem, err error) {
+	m, err := getvalue(self.metacache, slicedkey(objkey))
+	if err != nil {
+		return
+	}
+	sliced, err = decodesliced(m)
+	if err == nil && sliced.SliceSize <= 0 {
+		err = errmetaformat
+	}
+	return
+}
+
+func (self *ProxyServer) storesliced(objkey []byte, sliced sliceditem) {
+	ttl := sliced.Meta.Lifetime + staleretention
+	self.bans.stored(time.Now().Add(ttl))
+	setvalue(self.metacache, slicedkey(objkey), encodesliced(sliced), ttl)
+}
+
+//Reads a sliced object, from cached slices where possible and fetching
+//missing ones from origin. Seekable, so ranges only touch the slices they need.
+type slicereader struct {
+	proxy   *ProxyServer
+	req     *transaction
+	service *Service
+	sliced  sliceditem
+	pos     int64
+	curidx  int64
+	cur     []byte
+}
+
+func (self *ProxyServer) newslicereader(req *transaction, service *Service, sliced sliceditem) *slicereader {
+	return &slicereader{proxy: self, req: req, service: service, sliced: sliced, curidx: -1}
+}
+
+func (self *slicereader) Read(p []byte) (n int, err error) {
+	if self.pos >= self.sliced.Size {
+		return 0, io.EOF
+	}
+	slicesize := self.sliced.SliceSize
+	idx := self.pos / slicesize
+	if idx != self.curidx {
+		self.cur, err = self.loadslice(idx)
+		if err != nil {
+			return
+		}
+		self.curidx = idx
+	}
+	offset := self.pos - idx*slicesize
+	if offset >= int64(len(self.cur)) {
+		//Slices are checked when loaded, this would be a bug
+		return 0, io.ErrUnexpectedEOF
+	}
+	n = copy(p, self.cur[offset:])
+	self.pos += int64(n)
+	return
+}
+
+func (self *slicereader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.pos
+	case io.SeekEnd:
+		offset += self.sliced.Size
+	default:
+		return self.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return self.pos, errors.New("negative position")
+	}
+	self.pos = offset
+	return self.pos, nil
+}
+
+func (self *slicereader) Close() error {
+	return nil
+}
+
+//Get a slice from cache, or from origin if we dont have it yet
+func (self *slicereader) loadslice(idx int64) (data []byte, err error) {
+	start := idx * self.sliced.SliceSize
+	length := self.sliced.slicelength(idx)
+	key := slicekey(self.req.objkey, self.sliced.Version, self.sliced.SliceSize, idx)
+	data, err = getvalue(self.proxy.objcache, key)
+	if err == nil && int64(len(data)) == length {
+		return
+	}
+	fetchstart := time.Now()
+	resp, err := fetchslice(self.req, self.service, start, length, &self.sliced.Meta, false)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	self.req.origintime += time.Since(fetchstart)
+	if resp.StatusCode != http.StatusPartialContent || sliceversion(resp.Header) != sliceversion(self.sliced.Meta.Header) || contentcoding(resp.Header) != contentcoding(self.sliced.Meta.Header) {
+		//Start over with the next request
+		self.proxy.metacache.Delete(slicedkey(self.req.objkey))
+		err = errslicechanged
+		return
+	}
+	data, err = readslice(resp, start, length)
+	if err != nil {
+		self.req.log("slice", idx, err)
+		return
+	}
+	setvalue(self.proxy.objcache, key, data, self.sliced.slicettl())
+	return
+}
@@ -0,0 +1,218 @@
+package goproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func slicecontent() []byte {
+	content := make([]byte, 100)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	return content
+}
+
+func servecontent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", `"v1"`)
+	http.ServeContent(w, r, "doc", time.Time{}, bytes.NewReader(slicecontent()))
+}
+
+func withslices(size int64) func(*Service) {
+	return func(service *Service) {
+		service.SliceSize = size
+	}
+}
+
+//Answer range requests with a 206 for the given range, whatever was asked
+func serverange(w http.ResponseWriter, start, end int) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/100", start, end))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(slicecontent()[start : end+1])
+}
+
+func Test_Slices(t *testing.T) {
+	content := string(slicecontent())
+	p := newtestproxy(t, servecontent, withslices(16))
+	if w := p.get("/doc"); readbody(w) != content {
+		t.Error("sliced object should be served whole, got", readbody(w))
+	}
+	w := p.get("/doc", "Range", "bytes=30-49")
+	if cachestatus(w) != "HIT" || readbody(w) != content[30:50] {
+		t.Error("range should be served from cached slices, got", cachestatus(w), readbody(w))
+	}
+	if n := p.fetched(); n != 7 {
+		t.Error("each slice should be fetched once, origin got", n, "requests")
+	}
+}
+
+func Test_SlicesBadOrigin(t *testing.T) {
+	content := string(slicecontent())
+	origins := map[string]http.HandlerFunc{
+		"short first slice": func(w http.ResponseWriter, r *http.Request) {
+			serverange(w, 0, 9)
+		},
+		"short slice": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == "bytes=0-49" {
+				serverange(w, 0, 49)
+				return
+			}
+			serverange(w, 50, 59)
+		},
+		"wrong slice": func(w http.ResponseWriter, r *http.Request) {
+			serverange(w, 0, 49)
+		},
+	}
+	for name, origin := range origins {
+		p := newtestproxy(t, origin, withslices(50))
+		for _, rangeheader := range []string{"", "bytes=80-89"} {
+			expected := content
+			if rangeheader != "" {
+				expected = content[80:90]
+			}
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				done <- p.get("/doc", "Range", rangeheader)
+			}()
+			select {
+			case w := <-done:
+				//Cut short, or a 502 if the first slice was already bad
+				if got := readbody(w); w.Code != http.StatusBadGateway && (got == expected || !strings.HasPrefix(expected, got)) {
+					t.Error(name, rangeheader, "should be cut short, got", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal(name, rangeheader, "should not hang")
+			}
+		}
+	}
+}
+
+func Test_SliceSizeChange(t *testing.T) {
+	content := string(slicecontent())
+	p := newtestproxy(t, servecontent, withslices(16))
+	p.get("/doc")
+	//Restart on the same stores with smaller slices
+	service := *p.configs["example.com"]
+	service.SliceSize = 10
+	restarted := NewProxyServerWithStores([]Service{service}, p.objcache, p.metacache, t.TempDir())
+	r := httptest.NewRequest("GET", "/doc", nil)
+	r.Host = "example.com"
+	r.Header.Set("Range", "bytes=20-29")
+	w := httptest.NewRecorder()
+	restarted.handler(w, r)
+	if readbody(w) != content[20:30] {
+		t.Error("slices should be read at the size they were stored with, got", readbody(w))
+	}
+}
+
+func Test_SlicesVary(t *testing.T) {
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", r.Header.Get("Accept-Language"))
+		servecontent(w, r)
+	}, withslices(50))
+	for _, lang := range []string{"en", "fr"} {
+		if w := p.get("/doc", "Accept-Language", lang); cachestatus(w) != "MISS" {
+			t.Error(lang, "should be fetched, got", cachestatus(w))
+		}
+		if n := p.fetched(); n != 2 {
+			t.Error(lang, "each slice should be fetched once, origin got", n, "requests")
+		}
+	}
+	for _, lang := range []string{"en", "fr"} {
+		w := p.get("/doc", "Accept-Language", lang)
+		if cachestatus(w) != "HIT" || w.Header().Get("Content-Language") != lang || readbody(w) != string(slicecontent()) {
+			t.Error(lang, "variant should be served from its slices, got", cachestatus(w), w.Header())
+		}
+	}
+	if n := p.fetched(); n != 0 {
+		t.Error("cached variants should not go to origin, got", n)
+	}
+}
+
+func Test_SlicesOnlyIfCached(t *testing.T) {
+	p := newtestproxy(t, servecontent, withslices(16))
+	if w := p.get("/doc", "Cache-Control", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Error("object not fetched yet should be a 504, got", w.Code)
+	}
+	p.get("/doc")
+	w := p.get("/doc", "Cache-Control", "only-if-cached")
+	if w.Code != http.StatusOK || cachestatus(w) != "HIT" || readbody(w) != string(slicecontent()) {
+		t.Error("cached sliced object should be served, got", w.Code, cachestatus(w))
+	}
+}
+
+func gzipped(content []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	return buf.Bytes()
+}
+
+//Serve text in gzip or identity, both with the same ETag. ignore picks the
+//coding by the order of requests instead of Accept-Encoding.
+func codingorigin(content []byte, ignore bool) (http.HandlerFunc, *int32) {
+	var requests int32
+	gzips := new(int32)
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := content
+		usegzip := r.Header.Get("Accept-Encoding") == "gzip"
+		if ignore {
+			usegzip = atomic.AddInt32(&requests, 1) == 1
+		}
+		if usegzip {
+			atomic.AddInt32(gzips, 1)
+			w.Header().Set("Content-Encoding", "gzip")
+			body = gzipped(content)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		servecontentbytes(w, r, body)
+	}, gzips
+}
+
+func servecontentbytes(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", `"v1"`)
+	http.ServeContent(w, r, "doc", time.Time{}, bytes.NewReader(body))
+}
+
+func Test_SlicesCoding(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	content := make([]byte, 500)
+	for i := range content {
+		content[i] = byte('a' + rnd.Intn(26))
+	}
+	origin, gzips := codingorigin(content, false)
+	p := newtestproxy(t, origin, withslices(64))
+	//A gzip client gets the object stored gzipped
+	if w := p.get("/doc", "Accept-Encoding", "gzip", "Range", "bytes=0-9"); w.Code != http.StatusPartialContent {
+		t.Fatal("gzip client should get its range, got", w.Code)
+	}
+	w := p.get("/doc")
+	if w.Code != http.StatusOK || readbody(w) != string(content) {
+		t.Error("plain client should get the stored object gunzipped, got", w.Code, cachestatus(w))
+	}
+	if n := p.fetched(); int32(n) != atomic.LoadInt32(gzips) {
+		t.Error("every slice should be fetched gzipped, got", atomic.LoadInt32(gzips), "of", n)
+	}
+
+	origin, _ = codingorigin(content, true)
+	p = newtestproxy(t, origin, withslices(64))
+	p.get("/doc", "Accept-Encoding", "gzip", "Range", "bytes=0-9")
+	w = p.get("/doc", "Accept-Encoding", "gzip")
+	if got := readbody(w); got == string(gzipped(content)) || !strings.HasPrefix(string(gzipped(content)), got) {
+		t.Error("slices in another coding should not be served, got", len(got), "bytes")
+	}
+}
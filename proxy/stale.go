@@ -0,0 +1,68 @@
+package goproxy
+
+import (
+	"context"
+	"github.com/sajal/gohttpcache/cache"
+	"io"
+	"net/http"
+	"time"
+)
+
+//Stands in for the client of a background refresh
+type discardwriter struct {
+	header http.Header
+}
+
+func (self *discardwriter) Header() http.Header {
+	return self.header
+}
+
+func (self *discardwriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (self *discardwriter) WriteHeader(status int) {}
+
+//Serve a stored response past its freshness lifetime, rfc5861
+func (self *transaction) servestale(meta MetaItem, item io.ReadCloser, warning string) {
+	meta.Header = meta.Header.Clone()
+	meta.Header.Add("Warning", warning)
+	self.hit = true
+	self.stale = true
+	self.servebody(meta, item)
+}
+
+//Can a stored response stand in for an origin error, rfc5861 section 4
+func (self *transaction) servableonerror(meta MetaItem) bool {
+	return meta.StaleIfError > 0 && self.policy.Acceptable(meta.Lifetime+meta.StaleIfError, meta.age(time.Now()), false)
+}
+
+//Revalidate a stale object without making the client wait, rfc5861 section
+//3. Only one refresh per object runs at a time, and misses that come in
+//meanwhile join it like any other fetch.
+func (self *ProxyServer) refreshinbackground(req *transaction, service *Service, meta MetaItem) {
+	f, leader := self.joinflight(req.objkey)
+	if !leader {
+		//Already being fetched
+		f.release()
+		return
+	}
+	bg := newrequest(&discardwriter{header: make(http.Header)}, req.clientreq.Clone(context.Background()))
+	bg.logid = req.logid + "-refresh"
+	bg.metakey = req.metakey
+	bg.objkey = req.objkey
+	bg.policy = gohttpcache.RequestPolicy{}
+	bg.flight = f
+	self.refreshes.Add(1)
+	go func() {
+		defer self.refreshes.Done()
+		defer self.land(bg.objkey, f)
+		defer func() {
+			//No client connection to abort, see fail
+			if r := recover(); r != nil && r != http.ErrAbortHandler {
+				panic(r)
+			}
+		}()
+		self.revalidate(bg, service, meta, http.NoBody)
+	}()
+}
@@ -0,0 +1,67 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_StaleWhileRevalidate(t *testing.T) {
+	var version int32
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&version, 1) == 1 {
+			//Stored 9 seconds past its freshness lifetime
+			w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+			w.Header().Set("Age", "10")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("v1"))
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("v2"))
+	})
+	p.get("/doc")
+	w := p.get("/doc")
+	if cachestatus(w) != "STALE" || readbody(w) != "v1" || !strings.HasPrefix(w.Header().Get("Warning"), "110") {
+		t.Error("stale copy should be served right away with a 110 warning, got", cachestatus(w), readbody(w), w.Header())
+	}
+	body := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && body != "v2"; time.Sleep(time.Millisecond) {
+		w = p.get("/doc")
+		body = readbody(w)
+	}
+	if cachestatus(w) != "HIT" || body != "v2" || w.Header().Get("Warning") != "" {
+		t.Error("background refresh should replace the stored copy, got", cachestatus(w), body, w.Header())
+	}
+	if n := p.fetched(); n != 2 {
+		t.Error("origin should be asked once for the refresh, got", n-1)
+	}
+}
+
+func Test_StaleIfError(t *testing.T) {
+	var failing int32
+	p := newtestproxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		w.Header().Set("Age", "10")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("v1"))
+	})
+	p.get("/doc")
+	atomic.StoreInt32(&failing, 1)
+	for _, how := range []string{"origin 5xx", "origin unreachable"} {
+		if how == "origin unreachable" {
+			p.origin.Close()
+		}
+		w := p.get("/doc")
+		if cachestatus(w) != "STALE" || readbody(w) != "v1" || !strings.HasPrefix(w.Header().Get("Warning"), "111") {
+			t.Error(how, "should serve the stale copy with a 111 warning, got", w.Code, cachestatus(w), readbody(w), w.Header())
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	//ErrNotFound is returned by a Store for keys it does not hold, or that expired
+	ErrNotFound  = errors.New("not found in store")
+	errstoresize = errors.New("value size does not match what was reserved")
+)
+
+//How long things we have no expiry for are kept, as long as there is room
+const maxttl = 100 * 365 * 24 * time.Hour
+
+//Store is where a ProxyServer keeps objects, and separately their metadata.
+//Implementations must be safe for concurrent use.
+type Store interface {
+	//Get opens a stored value for reading. Close it when done.
+	Get(key []byte) (StoreItem, error)
+	//Set starts storing a value of exactly size bytes, kept for ttl. It is
+	//written in pieces and only visible to Get once committed.
+	Set(key []byte, size int, ttl time.Duration) (StoreTxn, error)
+	//Delete removes a value, reporting if there was one
+	Delete(key []byte) bool
+	//Stat tells how big a stored value is and how long it is kept for
+	Stat(key []byte) (size int, ttl time.Duration, err error)
+}
+
+//StoreItem is a stored value being read
+type StoreItem interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+//StoreTxn is a value being stored. Either Commit or Rollback it.
+type StoreTxn interface {
+	io.Writer
+	Commit() error
+	Rollback()
+}
+
+//A Recoverer is a Store that outlives the process, and took stock of what
+//an earlier one left behind when it was opened
+type Recoverer interface {
+	Recovered() StoreReport
+}
+
+//StoreReport tells what a Store found of an earlier run when opened
+type StoreReport struct {
+	Name        string    //Where it keeps things
+	Reused      bool      //Something was there to reuse
+	Counted     bool      //Entries and Bytes are known, not every store can count what it holds
+	Entries     int64     //Values recovered
+	Bytes       int64     //Their size
+	Expires     time.Time //When the last of them expires, zero if unknown
+	Removed     int64     //Expired, partially written or evicted values cleaned up
+	Quarantined []string  //Corrupt files moved aside, where they are now
+}
+
+func (self StoreReport) String() string {
+	var s string
+	if self.Name != "" {
+		s = self.Name + ": "
+	}
+	switch {
+	case !self.Reused:
+		s += "started empty"
+	case !self.Counted:
+		s += "reused, contents unknown"
+	default:
+		s += fmt.Sprintf("recovered %d entries, %d bytes", self.Entries, self.Bytes)
+	}
+	if self.Removed > 0 {
+		s += fmt.Sprintf(", removed %d", self.Removed)
+	}
+	if len(self.Quarantined) > 0 {
+		s += ", quarantined " + strings.Join(self.Quarantined, " ")
+	}
+	return s
+}
+
+//Move a corrupt file into dir for inspection, rather than deleting it
+func quarantine(path, dir string) (moved string, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	moved = filepath.Join(dir, filepath.Base(path)+".corrupt-"+time.Now().Format("20060102150405"))
+	err = os.Rename(path, moved)
+	return
+}
+
+//Small values such as metadata are read whole
+func getvalue(store Store, key []byte) (value []byte, err error) {
+	item, err := store.Get(key)
+	if err != nil {
+		return
+	}
+	defer item.Close()
+	return ioutil.ReadAll(item)
+}
+
+func setvalue(store Store, key, value []byte, ttl time.Duration) (err error) {
+	txn, err := store.Set(key, len(value), ttl)
+	if err != nil {
+		return
+	}
+	_, err = txn.Write(value)
+	if err != nil {
+		txn.Rollback()
+		return
+	}
+	return txn.Commit()
+}
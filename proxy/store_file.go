@@ -0,0 +1,337 @@
+package goproxy
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Bytes preceding each value in its file, the expiry in unix nanoseconds
+const fileheadersize = 8
+
+//Where files that are not ours, or too short to be, are moved on startup
+const quarantinedir = "quarantine"
+
+var errstorefile = errors.New("not a value file")
+
+//Store keeping each value in its own file under a directory, named by the
+//hash of its key. Values are written aside and renamed into place on commit,
+//so readers never see a partial one. Once the files add up to more than its
+//size the least recently used ones are removed, like memorystore does.
+//Expired values are removed when next looked up, or when evicted.
+type filestore struct {
+	dir     string
+	report  StoreReport
+	mu      sync.Mutex
+	maxsize int64
+	size    int64      //Of all the files, headers included
+	lru     *list.List //Of *fileentry, most recently used first
+	files   map[string]*list.Element
+}
+
+type fileentry struct {
+	path    string
+	size    int64
+	expires time.Time
+}
+
+//NewFileStore stores up to maxsize bytes of files under dir, creating it if
+//needed. Values left there by an earlier run are kept, as far as they fit.
+//Opening walks the whole directory to clean up after it, see Recovered.
+func NewFileStore(dir string, maxsize int64) (Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	store := &filestore{dir: dir, maxsize: maxsize, lru: list.New(), files: make(map[string]*list.Element)}
+	store.report, err = store.recover()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+//Take stock of what an earlier run left in the directory. Values it did
+//not finish writing and expired ones are removed, anything else that cannot
+//be a value of ours is quarantined. Those modified longest ago are evicted
+//if they do not all fit.
+func (self *filestore) recover() (report StoreReport, err error) {
+	report.Name = self.dir
+	now := time.Now()
+	type recovered struct {
+		fileentry
+		modified time.Time
+	}
+	var found []recovered
+	err = filepath.Walk(self.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path == filepath.Join(self.dir, quarantinedir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), "goproxy-store") {
+			report.Removed++
+			return os.Remove(path)
+		}
+		expires, err := self.readexpiry(path, fi)
+		if err != nil {
+			moved, err := quarantine(path, filepath.Join(self.dir, quarantinedir))
+			if err != nil {
+				return err
+			}
+			report.Quarantined = append(report.Quarantined, moved)
+			return nil
+		}
+		if !now.Before(expires) {
+			report.Removed++
+			return os.Remove(path)
+		}
+		report.Reused = true
+		found = append(found, recovered{fileentry{path: path, size: fi.Size(), expires: expires}, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modified.Before(found[j].modified) })
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for i := range found {
+		e := found[i].fileentry
+		report.Removed += int64(len(self.put(&e)))
+	}
+	report.Counted = true
+	for el := self.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*fileentry)
+		report.Entries++
+		report.Bytes += e.size - fileheadersize
+		if e.expires.After(report.Expires) {
+			report.Expires = e.expires
+		}
+	}
+	return
+}
+
+//Account for a file now in place, and remove those least recently used
+//until everything fits. Must hold the lock.
+func (self *filestore) put(e *fileentry) (evicted []*fileentry) {
+	if el, ok := self.files[e.path]; ok {
+		self.remove(el)
+	}
+	self.files[e.path] = self.lru.PushFront(e)
+	self.size += e.size
+	for self.size > self.maxsize {
+		el := self.lru.Back()
+		evicted = append(evicted, el.Value.(*fileentry))
+		self.remove(el)
+	}
+	for _, e := range evicted {
+		os.Remove(e.path)
+	}
+	return
+}
+
+//Must hold the lock
+func (self *filestore) remove(el *list.Element) {
+	e := self.lru.Remove(el).(*fileentry)
+	delete(self.files, e.path)
+	self.size -= e.size
+}
+
+//Mark a file used, or forget it once it is gone
+func (self *filestore) touch(path string, exists bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	el, ok := self.files[path]
+	if !ok {
+		return
+	}
+	if exists {
+		self.lru.MoveToFront(el)
+	} else {
+		self.remove(el)
+	}
+}
+
+//The expiry of a value file, which must be where its name says and big
+//enough to have one
+func (self *filestore) readexpiry(path string, fi os.FileInfo) (expires time.Time, err error) {
+	name := fi.Name()
+	_, herr := hex.DecodeString(name)
+	if herr != nil || len(name) != 2*sha1.Size || path != filepath.Join(self.dir, name[:2], name) || fi.Size() < fileheadersize {
+		err = errstorefile
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var header [fileheadersize]byte
+	_, err = io.ReadFull(f, header[:])
+	expires = time.Unix(0, int64(binary.LittleEndian.Uint64(header[:])))
+	return
+}
+
+func (self *filestore) Recovered() StoreReport {
+	return self.report
+}
+
+//Spread over 256 subdirectories so none gets too big
+func (self *filestore) path(key []byte) string {
+	sum := sha1.Sum(key)
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(self.dir, name[:2], name)
+}
+
+//Open the file of a value, if it has not expired
+func (self *filestore) open(key []byte) (f *os.File, size int64, expires time.Time, err error) {
+	path := self.path(key)
+	f, err = os.Open(path)
+	if os.IsNotExist(err) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	var header [fileheadersize]byte
+	_, err = io.ReadFull(f, header[:])
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			size = fi.Size() - fileheadersize
+		}
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	expires = time.Unix(0, int64(binary.LittleEndian.Uint64(header[:])))
+	if !time.Now().Before(expires) {
+		f.Close()
+		os.Remove(path)
+		self.touch(path, false)
+		err = ErrNotFound
+		return
+	}
+	self.touch(path, true)
+	return
+}
+
+func (self *filestore) Get(key []byte) (StoreItem, error) {
+	f, size, _, err := self.open(key)
+	if err != nil {
+		return nil, err
+	}
+	return &fileitem{SectionReader: io.NewSectionReader(f, fileheadersize, size), file: f}, nil
+}
+
+func (self *filestore) Set(key []byte, size int, ttl time.Duration) (StoreTxn, error) {
+	if int64(size)+fileheadersize > self.maxsize {
+		return nil, errstorefull
+	}
+	path := self.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	//Same directory, so the rename cannot cross filesystems
+	f, err := ioutil.TempFile(filepath.Dir(path), "goproxy-store")
+	if err != nil {
+		return nil, err
+	}
+	var header [fileheadersize]byte
+	expires := time.Now().Add(ttl)
+	binary.LittleEndian.PutUint64(header[:], uint64(expires.UnixNano()))
+	_, err = f.Write(header[:])
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &filetxn{store: self, file: f, path: path, size: int64(size), expires: expires}, nil
+}
+
+func (self *filestore) Delete(key []byte) bool {
+	path := self.path(key)
+	self.touch(path, false)
+	return os.Remove(path) == nil
+}
+
+func (self *filestore) Stat(key []byte) (size int, ttl time.Duration, err error) {
+	f, n, expires, err := self.open(key)
+	if err != nil {
+		return
+	}
+	f.Close()
+	return int(n), time.Until(expires), nil
+}
+
+type fileitem struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (self *fileitem) Close() error {
+	return self.file.Close()
+}
+
+type filetxn struct {
+	store   *filestore
+	file    *os.File
+	path    string
+	size    int64
+	written int64
+	expires time.Time
+}
+
+func (self *filetxn) Write(p []byte) (n int, err error) {
+	if self.written+int64(len(p)) > self.size {
+		return 0, errstoresize
+	}
+	n, err = self.file.Write(p)
+	self.written += int64(n)
+	return
+}
+
+func (self *filetxn) Commit() (err error) {
+	if self.written != self.size {
+		self.Rollback()
+		return errstoresize
+	}
+	err = self.file.Close()
+	if err != nil {
+		os.Remove(self.file.Name())
+		return
+	}
+	//Under the lock, so an eviction cannot remove the file just renamed
+	self.store.mu.Lock()
+	defer self.store.mu.Unlock()
+	err = os.Rename(self.file.Name(), self.path)
+	if err != nil {
+		os.Remove(self.file.Name())
+		return
+	}
+	self.store.put(&fileentry{path: self.path, size: self.size + fileheadersize, expires: self.expires})
+	return
+}
+
+func (self *filetxn) Rollback() {
+	self.file.Close()
+	os.Remove(self.file.Name())
+}
@@ -0,0 +1,142 @@
+package goproxy
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errstorefull = errors.New("value is larger than the store")
+
+//Store keeping values in memory, evicting the least recently used ones once
+//over its size. Expired values go when next looked up, or when evicted.
+type memorystore struct {
+	mu      sync.Mutex
+	maxsize int64
+	size    int64
+	lru     *list.List //Of *memoryentry, most recently used first
+	entries map[string]*list.Element
+}
+
+type memoryentry struct {
+	key     string
+	value   []byte //Never modified once stored, readers share it
+	expires time.Time
+}
+
+//NewMemoryStore stores up to maxsize bytes of values in memory. Needs no
+//cgo, handy for tests and for small caches.
+func NewMemoryStore(maxsize int64) Store {
+	return &memorystore{maxsize: maxsize, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+//Look up an entry and mark it used. Must hold the lock.
+func (self *memorystore) entry(key []byte) *memoryentry {
+	el, ok := self.entries[string(key)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*memoryentry)
+	if !time.Now().Before(e.expires) {
+		self.remove(el)
+		return nil
+	}
+	self.lru.MoveToFront(el)
+	return e
+}
+
+//Must hold the lock
+func (self *memorystore) remove(el *list.Element) {
+	e := self.lru.Remove(el).(*memoryentry)
+	delete(self.entries, e.key)
+	self.size -= int64(len(e.value))
+}
+
+//Store an entry, returning those evicted to make room
+func (self *memorystore) put(e *memoryentry) (evicted []*memoryentry) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if el, ok := self.entries[e.key]; ok {
+		self.remove(el)
+	}
+	self.entries[e.key] = self.lru.PushFront(e)
+	self.size += int64(len(e.value))
+	for self.size > self.maxsize {
+		el := self.lru.Back()
+		evicted = append(evicted, el.Value.(*memoryentry))
+		self.remove(el)
+	}
+	return
+}
+
+func (self *memorystore) Get(key []byte) (StoreItem, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	e := self.entry(key)
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	return &memoryitem{Reader: bytes.NewReader(e.value)}, nil
+}
+
+func (self *memorystore) Set(key []byte, size int, ttl time.Duration) (StoreTxn, error) {
+	if int64(size) > self.maxsize {
+		return nil, errstorefull
+	}
+	e := &memoryentry{key: string(key), value: make([]byte, 0, size), expires: time.Now().Add(ttl)}
+	return &memorytxn{store: self, entry: e}, nil
+}
+
+func (self *memorystore) Delete(key []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	el, ok := self.entries[string(key)]
+	if ok {
+		self.remove(el)
+	}
+	return ok
+}
+
+func (self *memorystore) Stat(key []byte) (size int, ttl time.Duration, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	e := self.entry(key)
+	if e == nil {
+		return 0, 0, ErrNotFound
+	}
+	return len(e.value), time.Until(e.expires), nil
+}
+
+type memoryitem struct {
+	*bytes.Reader
+}
+
+func (self *memoryitem) Close() error {
+	return nil
+}
+
+type memorytxn struct {
+	store *memorystore
+	entry *memoryentry
+}
+
+func (self *memorytxn) Write(p []byte) (n int, err error) {
+	e := self.entry
+	if len(e.value)+len(p) > cap(e.value) {
+		return 0, errstoresize
+	}
+	e.value = append(e.value, p...)
+	return len(p), nil
+}
+
+func (self *memorytxn) Commit() error {
+	if len(self.entry.value) != cap(self.entry.value) {
+		return errstoresize
+	}
+	self.store.put(self.entry)
+	return nil
+}
+
+func (self *memorytxn) Rollback() {}
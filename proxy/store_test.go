@@ -0,0 +1,361 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func storestotest(t *testing.T) map[string]Store {
+	filestore, err := NewFileStore(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{
+		"memory": NewMemoryStore(1 << 20),
+		"file":   filestore,
+	}
+}
+
+func Test_Stores(t *testing.T) {
+	for name, store := range storestotest(t) {
+		key := []byte("GETt/foo")
+		if _, err := store.Get(key); err != ErrNotFound {
+			t.Error(name, "get before set should be ErrNotFound, got", err)
+		}
+		txn, err := store.Set(key, 11, time.Hour)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		txn.Write([]byte("hello "))
+		if _, err := store.Get(key); err != ErrNotFound {
+			t.Error(name, "uncommitted value should not be visible, got", err)
+		}
+		txn.Write([]byte("world"))
+		if err := txn.Commit(); err != nil {
+			t.Fatal(name, err)
+		}
+		item, err := store.Get(key)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		item.Seek(6, io.SeekStart)
+		got, _ := ioutil.ReadAll(item)
+		item.Close()
+		if string(got) != "world" {
+			t.Error(name, "read after seek should be world, got", string(got))
+		}
+		size, ttl, err := store.Stat(key)
+		if err != nil || size != 11 || ttl <= 0 || ttl > time.Hour {
+			t.Error(name, "stat should be 11 bytes for up to an hour, got", size, ttl, err)
+		}
+
+		//Size is enforced both ways, and failed values are not stored
+		txn, _ = store.Set([]byte("short"), 4, time.Hour)
+		txn.Write([]byte("abc"))
+		if err := txn.Commit(); err == nil {
+			t.Error(name, "commit of a short value should fail")
+		}
+		txn, _ = store.Set([]byte("long"), 2, time.Hour)
+		if _, err := txn.Write([]byte("abc")); err == nil {
+			t.Error(name, "write past the size should fail")
+		}
+		txn.Rollback()
+		for _, k := range []string{"short", "long"} {
+			if _, err := store.Get([]byte(k)); err != ErrNotFound {
+				t.Error(name, k, "should not be stored, got", err)
+			}
+		}
+
+		if err := setvalue(store, []byte("expired"), []byte("x"), -time.Second); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := store.Get([]byte("expired")); err != ErrNotFound {
+			t.Error(name, "expired value should be ErrNotFound, got", err)
+		}
+
+		if !store.Delete(key) {
+			t.Error(name, "delete should report the value was there")
+		}
+		if store.Delete(key) {
+			t.Error(name, "second delete should report nothing was there")
+		}
+		if _, err := getvalue(store, key); err != ErrNotFound {
+			t.Error(name, "get after delete should be ErrNotFound, got", err)
+		}
+	}
+}
+
+func Test_MemoryStoreEviction(t *testing.T) {
+	store := NewMemoryStore(10)
+	setvalue(store, []byte("a"), []byte("aaaa"), time.Hour)
+	setvalue(store, []byte("b"), []byte("bbbb"), time.Hour)
+	//a is now more recently used than b
+	getvalue(store, []byte("a"))
+	setvalue(store, []byte("c"), []byte("cccc"), time.Hour)
+	if _, err := store.Get([]byte("b")); err != ErrNotFound {
+		t.Error("least recently used value should be evicted, got", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, err := store.Get([]byte(k)); err != nil {
+			t.Error(k, "should still be stored, got", err)
+		}
+	}
+	if _, err := store.Set([]byte("d"), 11, time.Hour); err == nil {
+		t.Error("value larger than the store should be refused")
+	}
+}
+
+func Test_FileStoreEviction(t *testing.T) {
+	dir := t.TempDir()
+	//Room for two 4 byte values and their headers
+	store, _ := NewFileStore(dir, 2*(4+fileheadersize)+1)
+	setvalue(store, []byte("a"), []byte("aaaa"), time.Hour)
+	setvalue(store, []byte("b"), []byte("bbbb"), time.Hour)
+	//a is now more recently used than b
+	getvalue(store, []byte("a"))
+	setvalue(store, []byte("c"), []byte("cccc"), time.Hour)
+	if _, err := store.Get([]byte("b")); err != ErrNotFound {
+		t.Error("least recently used value should be evicted, got", err)
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, err := store.Get([]byte(k)); err != nil {
+			t.Error(k, "should still be stored, got", err)
+		}
+	}
+	if _, err := store.Set([]byte("d"), 20, time.Hour); err == nil {
+		t.Error("value larger than the store should be refused")
+	}
+	//Deleted values make room
+	store.Delete([]byte("a"))
+	setvalue(store, []byte("d"), []byte("dddd"), time.Hour)
+	if _, err := store.Get([]byte("c")); err != nil {
+		t.Error("deleted value should have made room, got", err)
+	}
+
+	//Reopened smaller, only the most recently written value fits
+	os.Chtimes(store.(*filestore).path([]byte("c")), time.Now(), time.Now().Add(-time.Minute))
+	reopened, _ := NewFileStore(dir, 4+fileheadersize)
+	if report := reopened.(Recoverer).Recovered(); !report.Counted || report.Entries != 1 || report.Bytes != 4 || report.Removed != 1 {
+		t.Error("unexpected report", report)
+	}
+	if value, err := getvalue(reopened, []byte("d")); err != nil || string(value) != "dddd" {
+		t.Error("newest value should be kept, got", string(value), err)
+	}
+}
+
+func Test_ProxyServerWithStores(t *testing.T) {
+	var fetches int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("stored"))
+	}))
+	defer origin.Close()
+	for name, store := range storestotest(t) {
+		atomic.StoreInt32(&fetches, 0)
+		service := Service{Id: "t", Origin: origin.Listener.Addr().String(), Hostnames: []string{"example.com"}}
+		proxy := NewProxyServerWithStores([]Service{service}, NewTieredStore(1<<20, store, 2), NewMemoryStore(1<<20), t.TempDir())
+		cached := []string{}
+		for i := 0; i < 4; i++ {
+			r := httptest.NewRequest("GET", "/obj", nil)
+			r.Host = "example.com"
+			w := httptest.NewRecorder()
+			proxy.handler(w, r)
+			if w.Body.String() != "stored" {
+				t.Error(name, "body should be stored, got", w.Body.String())
+			}
+			cached = append(cached, strings.Fields(w.Header().Get("X-GP-Cache"))[0:2]...)
+		}
+		if strings.Join(cached[2:], " ") != "HIT disk HIT disk HIT memory" {
+			t.Error(name, "hits should report their tier, got", cached[2:])
+		}
+		if n := atomic.LoadInt32(&fetches); n != 1 {
+			t.Error(name, "second request should be a hit, origin was fetched", n, "times")
+		}
+	}
+}
+
+func Test_TieredStore(t *testing.T) {
+	cold := NewMemoryStore(1 << 20)
+	store := NewTieredStore(8*8, cold, 2)
+	setvalue(store, []byte("a"), []byte("aaaaaaaa"), time.Hour)
+	tiers := []string{}
+	for i := 0; i < 3; i++ {
+		item, err := store.Get([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiers = append(tiers, storetier(item))
+		item.Close()
+	}
+	if strings.Join(tiers, ",") != "disk,disk,memory" {
+		t.Error("should be promoted on the second cold hit, got", tiers)
+	}
+	if _, err := cold.Get([]byte("a")); err != ErrNotFound {
+		t.Error("promoted value should leave the cold tier, got", err)
+	}
+
+	//Fill memory so a is evicted, and moved back down
+	for i := 0; i < 8; i++ {
+		key := []byte{'b', byte('0' + i)}
+		setvalue(store, key, []byte("bbbbbbbb"), time.Hour)
+		getvalue(store, key)
+		getvalue(store, key)
+	}
+	if value, err := getvalue(cold, []byte("a")); err != nil || string(value) != "aaaaaaaa" {
+		t.Error("evicted value should be demoted, got", string(value), err)
+	}
+
+	//A new value replaces the promoted copy
+	setvalue(store, []byte("b7"), []byte("cccccccc"), time.Hour)
+	if value, _ := getvalue(store, []byte("b7")); string(value) != "cccccccc" {
+		t.Error("new value should be served, got", string(value))
+	}
+	stats := store.Stats()
+	if stats.Promotions != 9 || stats.Demotions != 1 || stats.HotHits != 1 {
+		t.Error("unexpected stats", stats)
+	}
+}
+
+//A store whose nth Get of a key waits for release
+type slowstore struct {
+	Store
+	key     string
+	nth     int32
+	gets    int32
+	waiting chan bool
+	release chan bool
+}
+
+func (self *slowstore) Get(key []byte) (StoreItem, error) {
+	if string(key) == self.key && atomic.AddInt32(&self.gets, 1) == self.nth {
+		self.waiting <- true
+		<-self.release
+	}
+	return self.Store.Get(key)
+}
+
+func Test_TieredStorePromote(t *testing.T) {
+	//The first Get finds it cold, the second reads it for promotion
+	cold := &slowstore{Store: NewMemoryStore(1 << 20), key: "a", nth: 2, waiting: make(chan bool), release: make(chan bool)}
+	store := NewTieredStore(1<<20, cold, 1)
+	setvalue(store, []byte("a"), []byte("old"), time.Hour)
+	go getvalue(store, []byte("a"))
+	<-cold.waiting
+	written := make(chan error)
+	go func() {
+		written <- setvalue(store, []byte("a"), []byte("new"), time.Hour)
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes should not wait for a promotion to read its value")
+	}
+	close(cold.release)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		store.mu.Lock()
+		n := len(store.promoting)
+		store.mu.Unlock()
+		if n == 0 {
+			break
+		}
+	}
+	if value, _ := getvalue(store.hot, []byte("a")); value != nil {
+		t.Error("value replaced while being promoted should not be promoted, got", string(value))
+	}
+	if value, _ := getvalue(store, []byte("a")); string(value) != "new" {
+		t.Error("new value should be served, got", string(value))
+	}
+}
+
+func Test_FileStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir, 1<<20)
+	setvalue(store, []byte("kept"), []byte("12345"), time.Hour)
+	setvalue(store, []byte("expired"), []byte("x"), -time.Second)
+	//A crash mid write, and a file that is not ours
+	store.Set([]byte("partial"), 10, time.Hour)
+	ioutil.WriteFile(dir+"/stray", []byte("abc"), 0644)
+
+	reopened, err := NewFileStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reopened.(Recoverer).Recovered()
+	if !report.Reused || report.Entries != 1 || report.Bytes != 5 || report.Removed != 2 || len(report.Quarantined) != 1 {
+		t.Error("unexpected report", report)
+	}
+	if report.Expires.Before(time.Now().Add(59*time.Minute)) || report.Expires.After(time.Now().Add(time.Hour)) {
+		t.Error("should expire with the kept value, got", report.Expires)
+	}
+	if value, err := getvalue(reopened, []byte("kept")); err != nil || string(value) != "12345" {
+		t.Error("value should survive a restart, got", string(value), err)
+	}
+	if _, err := ioutil.ReadFile(report.Quarantined[0]); err != nil {
+		t.Error("quarantined file should be kept for inspection", err)
+	}
+	//Quarantined files are left alone next time
+	again, _ := NewFileStore(dir, 1<<20)
+	if report := again.(Recoverer).Recovered(); report.Entries != 1 || len(report.Quarantined) != 0 {
+		t.Error("unexpected report on second restart", report)
+	}
+}
+
+func Test_WarmRestart(t *testing.T) {
+	var fetches int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("stored"))
+	}))
+	defer origin.Close()
+	service := Service{Id: "t", Origin: origin.Listener.Addr().String(), Hostnames: []string{"example.com"}}
+	dir := t.TempDir()
+	start := func() *ProxyServer {
+		objstore, _ := NewFileStore(dir+"/obj", 1<<20)
+		metastore, _ := NewFileStore(dir+"/meta", 1<<20)
+		return NewProxyServerWithStores([]Service{service}, NewTieredStore(1<<20, objstore, 1), metastore, dir)
+	}
+	get := func(proxy *ProxyServer, path string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "example.com"
+		w := httptest.NewRecorder()
+		proxy.handler(w, r)
+		return strings.Fields(w.Header().Get("X-GP-Cache"))[0]
+	}
+
+	proxy := start()
+	get(proxy, "/a")
+	get(proxy, "/b")
+	//Promoted to memory, it has to make it to disk on the way out
+	get(proxy, "/a")
+	proxy.Ban("", "^/b$", "", "")
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy = start()
+	report := proxy.StartupReport()
+	if report.Objects.Entries != 2 || report.Metadata.Entries == 0 {
+		t.Error("unexpected startup report", report)
+	}
+	if got := get(proxy, "/a"); got != "HIT" {
+		t.Error("object should be served from the recovered cache, got", got)
+	}
+	if got := get(proxy, "/b"); got != "MISS" {
+		t.Error("ban should survive a restart, got", got)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 3 {
+		t.Error("origin should be fetched for a, b and banned b, got", n)
+	}
+}
@@ -0,0 +1,243 @@
+package goproxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Tiers of a TieredStore, as reported in X-GP-Cache
+const (
+	hottier  = "memory"
+	coldtier = "disk"
+)
+
+//Only values up to this share of the hot tier are promoted, so a few big
+//ones cannot flush out everything else
+const hotshare = 8
+
+//How many keys we count cold hits for before starting over, so keys hit
+//once long ago do not pile up
+const maxtracked = 100000
+
+//TieredStore keeps values in a cold Store, usually on disk, and moves those
+//hit repeatedly into a bounded LRU in memory in front of it. Values evicted
+//from memory are moved back down. A value lives in one tier at a time, and
+//new values always start out cold.
+type TieredStore struct {
+	hot          *memorystore
+	cold         Store
+	promoteafter int
+	mu           sync.Mutex      //Held while moving values between tiers, and committing
+	coldhits     map[string]int  //Cold hits per key since it was last promoted
+	promoting    map[string]bool //Keys being read for promotion, true if written meanwhile
+	stats        TierStats
+}
+
+//TierStats counts hits per tier, and values moved between them
+type TierStats struct {
+	HotHits    int64
+	ColdHits   int64
+	Promotions int64
+	Demotions  int64
+}
+
+//NewTieredStore fronts cold with up to hotsize bytes in memory. Values are
+//promoted on their promoteafter-th cold hit.
+func NewTieredStore(hotsize int64, cold Store, promoteafter int) *TieredStore {
+	return &TieredStore{
+		hot:          NewMemoryStore(hotsize).(*memorystore),
+		cold:         cold,
+		promoteafter: promoteafter,
+		coldhits:     make(map[string]int),
+		promoting:    make(map[string]bool),
+	}
+}
+
+//Stats returns the counters so far
+func (self *TieredStore) Stats() TierStats {
+	return TierStats{
+		HotHits:    atomic.LoadInt64(&self.stats.HotHits),
+		ColdHits:   atomic.LoadInt64(&self.stats.ColdHits),
+		Promotions: atomic.LoadInt64(&self.stats.Promotions),
+		Demotions:  atomic.LoadInt64(&self.stats.Demotions),
+	}
+}
+
+func (self *TieredStore) Get(key []byte) (StoreItem, error) {
+	if item, err := self.hot.Get(key); err == nil {
+		atomic.AddInt64(&self.stats.HotHits, 1)
+		return &tieritem{StoreItem: item, tier: hottier}, nil
+	}
+	item, err := self.cold.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&self.stats.ColdHits, 1)
+	if self.counthit(key) && self.promote(key) {
+		if promoted, err := self.hot.Get(key); err == nil {
+			item.Close()
+			item = promoted
+		}
+	}
+	return &tieritem{StoreItem: item, tier: coldtier}, nil
+}
+
+//Count a cold hit, true if the value is now due for promotion
+func (self *TieredStore) counthit(key []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.coldhits) >= maxtracked {
+		self.coldhits = make(map[string]int)
+	}
+	self.coldhits[string(key)]++
+	if self.coldhits[string(key)] < self.promoteafter {
+		return false
+	}
+	delete(self.coldhits, string(key))
+	return true
+}
+
+//Move a value from the cold tier to the hot one, and whatever that evicts
+//back down. The value is read without holding the lock, and not promoted if
+//it was replaced or deleted meanwhile.
+func (self *TieredStore) promote(key []byte) bool {
+	self.mu.Lock()
+	if _, ok := self.promoting[string(key)]; ok {
+		self.mu.Unlock()
+		return false
+	}
+	self.promoting[string(key)] = false
+	self.mu.Unlock()
+	defer func() {
+		self.mu.Lock()
+		delete(self.promoting, string(key))
+		self.mu.Unlock()
+	}()
+
+	size, ttl, err := self.cold.Stat(key)
+	if err != nil || int64(size) > self.hot.maxsize/hotshare {
+		return false
+	}
+	value, err := getvalue(self.cold, key)
+	if err != nil || len(value) != size {
+		return false
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.promoting[string(key)] {
+		return false
+	}
+	evicted := self.hot.put(&memoryentry{key: string(key), value: value, expires: time.Now().Add(ttl)})
+	self.cold.Delete(key)
+	atomic.AddInt64(&self.stats.Promotions, 1)
+	for _, e := range evicted {
+		self.demote(e)
+	}
+	return true
+}
+
+//Must hold the lock
+func (self *TieredStore) demote(e *memoryentry) {
+	ttl := time.Until(e.expires)
+	if ttl <= 0 {
+		return
+	}
+	if setvalue(self.cold, []byte(e.key), e.value, ttl) == nil {
+		atomic.AddInt64(&self.stats.Demotions, 1)
+	}
+}
+
+func (self *TieredStore) Set(key []byte, size int, ttl time.Duration) (StoreTxn, error) {
+	txn, err := self.cold.Set(key, size, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &tieredtxn{StoreTxn: txn, store: self, key: key}, nil
+}
+
+//Must hold the lock
+func (self *TieredStore) written(key []byte) {
+	if _, ok := self.promoting[string(key)]; ok {
+		self.promoting[string(key)] = true
+	}
+}
+
+func (self *TieredStore) Delete(key []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.written(key)
+	hot := self.hot.Delete(key)
+	return self.cold.Delete(key) || hot
+}
+
+func (self *TieredStore) Stat(key []byte) (size int, ttl time.Duration, err error) {
+	size, ttl, err = self.hot.Stat(key)
+	if err == ErrNotFound {
+		return self.cold.Stat(key)
+	}
+	return
+}
+
+//Recovered reports what the cold tier recovered, memory starts out empty
+func (self *TieredStore) Recovered() StoreReport {
+	if r, ok := self.cold.(Recoverer); ok {
+		return r.Recovered()
+	}
+	return StoreReport{}
+}
+
+//Close moves everything in memory down to the cold tier, so it survives a
+//restart, then closes that
+func (self *TieredStore) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.hot.mu.Lock()
+	var entries []*memoryentry
+	for el := self.hot.lru.Back(); el != nil; el = el.Prev() {
+		entries = append(entries, el.Value.(*memoryentry))
+	}
+	self.hot.mu.Unlock()
+	for _, e := range entries {
+		self.demote(e)
+		self.hot.Delete([]byte(e.key))
+	}
+	if c, ok := self.cold.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+//An item and the tier it was found in
+type tieritem struct {
+	StoreItem
+	tier string
+}
+
+//Which tier of a TieredStore an item came from, empty for other stores
+func storetier(item StoreItem) string {
+	if t, ok := item.(*tieritem); ok {
+		return t.tier
+	}
+	return ""
+}
+
+type tieredtxn struct {
+	StoreTxn
+	store *TieredStore
+	key   []byte
+}
+
+//The new value replaces any promoted copy of the old one
+func (self *tieredtxn) Commit() error {
+	self.store.mu.Lock()
+	defer self.store.mu.Unlock()
+	err := self.StoreTxn.Commit()
+	if err == nil {
+		self.store.written(self.key)
+		self.store.hot.Delete(self.key)
+	}
+	return err
+}
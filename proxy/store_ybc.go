@@ -0,0 +1,133 @@
+//go:build cgo
+// +build cgo
+
+package goproxy
+
+import (
+	"github.com/valyala/ybc/bindings/go/ybc"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//Store backed by a ybc cache, file backed and bounded by size
+type ybcstore struct {
+	cache  *ybc.Cache
+	report StoreReport
+}
+
+//NewYbcStore stores in an open ybc cache
+func NewYbcStore(cache *ybc.Cache) Store {
+	return &ybcstore{cache: cache}
+}
+
+//OpenYbcStore opens a ybc cache of size MB holding at most maxitems, in the
+//files name.data and name.index, see OpenYbcCache.
+func OpenYbcStore(name string, size, maxitems int) (Store, error) {
+	cache, report, err := OpenYbcCache(name, size, maxitems)
+	if err != nil {
+		return nil, err
+	}
+	return &ybcstore{cache: cache, report: report}, nil
+}
+
+//OpenYbcCache opens a ybc cache of size MB holding at most maxitems, in the
+//files name.data and name.index. Files left by an earlier run are reused.
+//If ybc will not open them they are quarantined as name.*.corrupt-<time>,
+//and a new cache is created in their place.
+func OpenYbcCache(name string, size, maxitems int) (cache *ybc.Cache, report StoreReport, err error) {
+	cfg := ybc.Config{
+		MaxItemsCount: ybc.SizeT(maxitems),
+		DataFileSize:  ybc.SizeT(size) * ybc.SizeT(1024*1024),
+		DataFile:      name + ".data",
+		IndexFile:     name + ".index",
+	}
+	report = StoreReport{Name: name}
+	//Without force, ybc only opens intact existing files
+	cache, err = cfg.OpenCache(false)
+	if err == nil {
+		//ybc cannot count its items, nor tell when the last one expires.
+		//The ProxyServer keeps track of that itself, see banlist.
+		report.Reused = true
+		return
+	}
+	for _, path := range []string{cfg.DataFile, cfg.IndexFile} {
+		if _, serr := os.Stat(path); serr == nil {
+			moved, qerr := quarantine(path, filepath.Dir(path))
+			if qerr != nil {
+				return nil, report, qerr
+			}
+			log.Println(path, err, "quarantined as", moved)
+			report.Quarantined = append(report.Quarantined, moved)
+		}
+	}
+	cache, err = cfg.OpenCache(true)
+	return
+}
+
+func (self *ybcstore) Recovered() StoreReport {
+	return self.report
+}
+
+//Close syncs the cache to its files
+func (self *ybcstore) Close() error {
+	return self.cache.Close()
+}
+
+func (self *ybcstore) Get(key []byte) (StoreItem, error) {
+	item, err := self.cache.GetItem(key)
+	if err == ybc.ErrCacheMiss {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (self *ybcstore) Set(key []byte, size int, ttl time.Duration) (StoreTxn, error) {
+	if ttl > ybc.MaxTtl {
+		ttl = ybc.MaxTtl
+	}
+	txn, err := self.cache.NewSetTxn(key, size, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (self *ybcstore) Delete(key []byte) bool {
+	return self.cache.Delete(key)
+}
+
+func (self *ybcstore) Stat(key []byte) (size int, ttl time.Duration, err error) {
+	item, err := self.cache.GetItem(key)
+	if err == ybc.ErrCacheMiss {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	defer item.Close()
+	return item.Size(), item.Ttl(), nil
+}
+
+//Creates a new ProxyServer storing in ybc caches, needs cgo. Caches left in
+//cachedir by an earlier run are reused, see OpenYbcStore.
+//services : list of ServiceConfig
+//cachedir: directory to store the cache
+//metacachesize: Size (in MB) of metadata particularly vary info
+//objcachesize: Size (in MB) of actual cache objects
+//maxitems: Max items in each cache
+func NewProxyServer(services []Service, cachedir string, metacachesize, objcachesize, maxitems int) *ProxyServer {
+	metastore, err := OpenYbcStore(cachedir+"goproxy-meta", metacachesize, maxitems)
+	if err != nil {
+		log.Fatal(err)
+	}
+	objstore, err := OpenYbcStore(cachedir+"goproxy-obj", objcachesize, maxitems)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return NewProxyServerWithStores(services, objstore, metastore, cachedir)
+}
@@ -0,0 +1,185 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//How many Vary field lists and stored variants we track per primary key
+const (
+	maxvaries   = 8
+	maxvariants = 64
+)
+
+//Stripes of the locks serializing updates of variants records
+const variantstripes = 64
+
+//VaryNormalizer maps the value of a request header named in Vary to the
+//value that selects a variant. Requests whose values normalize the same share
+//a stored variant.
+type VaryNormalizer func(value string) string
+
+//The variants stored under a primary key (metakey), rfc7234 section 4.1.
+//Origin may change its Vary over time, so we remember every field list seen,
+//newest first, and try each of them on lookup.
+type variants struct {
+	Varies [][]string
+	Keys   [][]byte //objkeys of the stored variants, newest first
+}
+
+//parsevary lists the canonical field names in Vary, sorted so the order
+//they are listed in does not matter. Empty if the response does not vary.
+func parsevary(hdr http.Header) (vary []string) {
+	seen := make(map[string]bool)
+	for _, v := range hdr[http.CanonicalHeaderKey("Vary")] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if k != "" && !seen[k] {
+				seen[k] = true
+				vary = append(vary, k)
+			}
+		}
+	}
+	sort.Strings(vary)
+	return
+}
+
+//Normalize a request header value for the secondary key. Without a
+//normalizer for the field, whitespace is trimmed and multiple fields joined.
+func (self *Service) normalize(field string, values []string) string {
+	value := strings.Join(values, ",")
+	if normalizer, ok := self.VaryNormalizers[field]; ok {
+		return normalizer(value)
+	}
+	if field == "Accept-Encoding" {
+		return NormalizeAcceptEncoding(value)
+	}
+	parts := strings.Split(value, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return strings.Join(parts, ",")
+}
+
+//The objkey of the variant of metakey selected by the request headers.
+//Field names and normalized values are delimited and hashed, so they cannot
+//run into each other and the key stays short.
+func (self *Service) varykey(metakey []byte, reqhdrs http.Header, vary []string) []byte {
+	if len(vary) == 0 {
+		return metakey
+	}
+	h := sha1.New()
+	for _, field := range vary {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+		h.Write([]byte(self.normalize(field, reqhdrs[field])))
+		h.Write([]byte{0})
+	}
+	key := append([]byte(nil), metakey...)
+	key = append(key, []byte("\x00vary\x00")...)
+	return append(key, []byte(hex.EncodeToString(h.Sum(nil)))...)
+}
+
+//Lock the variants record of metakey for an update. Without it, concurrent
+//stores of different variants could each drop the key the other added.
+//Locks are striped, so they take no memory per key.
+func (self *ProxyServer) lockvariants(metakey []byte) *sync.Mutex {
+	mu := &self.variantmutexes[crc32.ChecksumIEEE(metakey)%variantstripes]
+	mu.Lock()
+	return mu
+}
+
+func (self *ProxyServer) getvariants(metakey []byte) (v variants, err error) {
+	m, err := getvalue(self.metacache, metakey)
+	if err != nil {
+		return
+	}
+	return decodevariants(m)
+}
+
+//Find the stored variant for the request, setting req.objkey. If none is
+//stored, objkey is where the newest Vary would put it.
+func (self *ProxyServer) lookup(req *transaction, service *Service) (item StoreItem, err error) {
+	v, err := self.getvariants(req.metakey)
+	req.objkey = req.metakey
+	if err != nil {
+		req.log("getvariants", err)
+		if err == ErrNotFound {
+			//Expired or evicted, if it was ever stored
+			self.index.remove(string(req.metakey))
+		}
+		item, err = self.objcache.Get(req.objkey)
+		if err == nil {
+			req.tier = storetier(item)
+		}
+		return
+	}
+	for i, vary := range v.Varies {
+		key := service.varykey(req.metakey, req.clientreq.Header, vary)
+		if i == 0 {
+			req.objkey = key
+		}
+		item, err = self.objcache.Get(key)
+		if err == nil {
+			req.objkey = key
+			req.tier = storetier(item)
+			return
+		}
+	}
+	return nil, ErrNotFound
+}
+
+//The Vary fields that select a stored variant. Accept-Encoding is left out
+//when we can serve the response in whatever coding a client accepts.
+func storedvary(hdr http.Header) (vary []string) {
+	if !transformable(hdr) {
+		return parsevary(hdr)
+	}
+	for _, field := range parsevary(hdr) {
+		if field != "Accept-Encoding" {
+			vary = append(vary, field)
+		}
+	}
+	return
+}
+
+//Record a variant about to be stored for ttl, and return the key to store
+//it under
+func (self *ProxyServer) storevariant(req *transaction, service *Service, hdr http.Header, ttl time.Duration) (key []byte, err error) {
+	vary := storedvary(hdr)
+	key = service.varykey(req.metakey, req.clientreq.Header, vary)
+	defer self.lockvariants(req.metakey).Unlock()
+	v, _ := self.getvariants(req.metakey)
+	v.Varies = prependvary(v.Varies, vary)
+	v.Keys = prependkey(v.Keys, key)
+	setvalue(self.metacache, req.metakey, encodevariants(v), maxttl)
+	self.index.add(service.Id, req.clientreq.RequestURI, surrogatekeys(hdr), req.metakey, ttl)
+	return
+}
+
+func prependvary(varies [][]string, vary []string) [][]string {
+	out := [][]string{vary}
+	for _, v := range varies {
+		if strings.Join(v, ",") != strings.Join(vary, ",") && len(out) < maxvaries {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func prependkey(keys [][]byte, key []byte) [][]byte {
+	out := [][]byte{key}
+	for _, k := range keys {
+		if !bytes.Equal(k, key) && len(out) < maxvariants {
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func varyorigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Vary", "Accept-Language, X-Device")
+	w.Write([]byte(r.Header.Get("Accept-Language") + " " + r.Header.Get("X-Device")))
+}
+
+func Test_Vary(t *testing.T) {
+	p := newtestproxy(t, varyorigin, func(service *Service) {
+		service.VaryNormalizers = map[string]VaryNormalizer{"X-Device": strings.ToLower}
+	})
+	for _, c := range []struct {
+		lang, device, status, body string
+	}{
+		{"en", "Phone", "MISS", "en Phone"},
+		{"fr", "Phone", "MISS", "fr Phone"},
+		{"en", "Phone", "HIT", "en Phone"},
+		{"fr", "Phone", "HIT", "fr Phone"},
+		//Normalized the same as en, Phone
+		{" en ", "PHONE", "HIT", "en Phone"},
+		{"en", "Tablet", "MISS", "en Tablet"},
+	} {
+		w := p.get("/doc", "Accept-Language", c.lang, "X-Device", c.device)
+		if cachestatus(w) != c.status || readbody(w) != c.body {
+			t.Error(c.lang, c.device, "should be", c.status, c.body, "got", cachestatus(w))
+		}
+	}
+	if n := p.PurgeURL("example.com", "/doc", false); n != 3 {
+		t.Error("purge should remove every variant, got", n)
+	}
+	for _, lang := range []string{"en", "fr"} {
+		if w := p.get("/doc", "Accept-Language", lang, "X-Device", "Phone"); cachestatus(w) != "MISS" {
+			t.Error(lang, "should be purged, got", cachestatus(w))
+		}
+	}
+}
+
+func Test_VaryNormalize(t *testing.T) {
+	service := &Service{VaryNormalizers: map[string]VaryNormalizer{"X-Device": strings.ToLower}}
+	for _, c := range []struct {
+		field    string
+		values   []string
+		expected string
+	}{
+		{"Accept-Language", []string{" en , fr "}, "en,fr"},
+		{"Accept-Language", []string{"en", " fr"}, "en,fr"},
+		{"Accept-Encoding", []string{"gzip, deflate"}, "gzip"},
+		{"Accept-Encoding", []string{"br;q=0, gzip;q=0"}, "identity"},
+		{"X-Device", []string{"Phone"}, "phone"},
+		{"X-Other", nil, ""},
+	} {
+		if got := service.normalize(c.field, c.values); got != c.expected {
+			t.Error(c.field, c.values, "should normalize to", c.expected, "got", got)
+		}
+	}
+}
+
+//Values take a while to arrive once read, so concurrent updates overlap
+type sleepystore struct {
+	Store
+}
+
+func (self *sleepystore) Get(key []byte) (StoreItem, error) {
+	item, err := self.Store.Get(key)
+	time.Sleep(time.Millisecond)
+	return item, err
+}
+
+func Test_VaryConcurrentStores(t *testing.T) {
+	p := newtestproxy(t, varyorigin)
+	p.metacache = &sleepystore{p.metacache}
+	//Let the proxy learn the Vary first, so the variants get their own keys
+	p.get("/doc", "Accept-Language", "en")
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/doc", nil)
+			r.Host = "example.com"
+			r.Header.Set("Accept-Language", strconv.Itoa(i))
+			p.handler(httptest.NewRecorder(), r)
+		}(i)
+	}
+	wg.Wait()
+	if n := p.PurgeURL("example.com", "/doc", false); n != 33 {
+		t.Error("every variant stored should be recorded, purged", n)
+	}
+}
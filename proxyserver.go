@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"github.com/sajal/gohttpcache/proxy"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -15,5 +20,22 @@ func main() {
 	services[0].Hostnames = []string{"cdn.cdnplanet.com", "foo.cdnplanet.com", "bar.cdnplanet.com"}
 	services[0].BaseKeyFunc = goproxy.QSIgnoreKeyFunc
 	proxy := goproxy.NewProxyServer(services, "/tmp/", 50, 500, 500000)
-	log.Fatal(proxy.ListenAndServe(":8066", 300*time.Second))
+	//Finish the requests in progress and close the cache on the way out, so
+	//the next run can reuse it
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	closed := make(chan struct{})
+	go func() {
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := proxy.Shutdown(ctx); err != nil {
+			log.Println("shutdown:", err)
+		}
+		close(closed)
+	}()
+	if err := proxy.ListenAndServe(":8066", 300*time.Second); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-closed
 }